@@ -0,0 +1,138 @@
+package main
+
+// build.go contains the build command, which turns bf files into executables
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rpalo/learning/bf/pkg/bf"
+)
+
+// build compiles a bf file to a native executable, by way of assembly or Go,
+// or by writing the executable directly.
+func build(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	output := flags.String("o", "", "name of the executable (default: FILENAME without .bf)")
+	direct := flags.Bool("direct", false, "write the executable directly instead of using as and ld")
+	viaGo := flags.Bool("via-go", false, "compile by way of Go with the local Go toolchain instead of as and ld")
+	compileOpts := compileFlags(flags, bf.MaxOptLevel)
+	filenames := parseInterspersed(flags, args)
+
+	if len(filenames) != 1 || (*direct && *viaGo) {
+		fmt.Print(USAGE)
+		os.Exit(2)
+	}
+	filename := filenames[0]
+	if *output == "" {
+		*output = strings.TrimSuffix(filepath.Base(filename), ".bf")
+	}
+	program := loadProgram(filename, compileOpts()...)
+
+	if *direct {
+		buildDirect(program, *output)
+		return
+	}
+	if *viaGo {
+		buildViaGo(program, *output)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "bf-build")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "prog.s")
+	object := filepath.Join(dir, "prog.o")
+	f, err := os.Create(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = bf.EmitAsm(f, program.Ops, config())
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := runTool("as", "-o", object, source); err != nil {
+		log.Fatal(err)
+	}
+	if err := runTool("ld", "-o", *output, object); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// buildDirect writes the executable without any external tools.
+func buildDirect(program *bf.Program, output string) {
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = bf.WriteELF(f, program.Ops, config())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// buildViaGo transpiles the program to Go and builds that with `go build`.
+func buildViaGo(program *bf.Program, output string) {
+	dir, err := os.MkdirTemp("", "bf-build")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "main.go")
+	f, err := os.Create(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = bf.EmitGo(f, program.Ops, config())
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := runTool("go", "build", "-o", output, source); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runTool runs an external program, passing its output through.
+func runTool(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// parseInterspersed parses flags that may come before or after the
+// positional arguments (e.g. `bf build FILE -o out`), and returns the
+// positional arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+// debug.go contains the interactive step debugger and its commands
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rpalo/learning/bf/pkg/bf"
+)
+
+const DEBUG_HELP = `
+The program is paused before the op shown.  Its input is read from the same
+place as these commands, unless it was given with -input or -input-string.
+
+commands:
+	step, s: run one op
+	next, n: run one op, or the whole loop if the op starts one
+	finish, f: run until the loop the op is in exits
+	continue, c: run until a breakpoint or a watched cell stops the program
+	reverse-step, rs: undo the last op
+	reverse-continue, rc: run backwards to just before the last op that hit a
+		breakpoint or changed a watched cell
+	break, b LINE:COL | OP: stop at the op at LINE:COL in the source, or at op
+		number OP.  Every '#' in the source is a breakpoint too
+	delete, d OP: remove the breakpoint at op number OP
+	watch cell N: stop whenever cell N changes
+	print, p tape[A:B]: show cells A up to (not including) B, or tape[N] for
+		just cell N
+	where, w: show the op the program is paused at
+	help, h: show this message
+	quit, q: stop the program and leave the debugger
+`
+
+// debugHistory is how many ops back the debugger can go.
+const debugHistory = 1 << 20
+
+// errQuit stops the program when the quit command is used.
+var errQuit = errors.New("quit")
+
+// debugger is the state of a debugging session.  It runs the program on a VM
+// with a step hook, where a bf.Debugger decides when to stop and ask what to
+// do next.
+type debugger struct {
+	program *bf.Program
+	lines   []string
+	vm      *bf.VM
+	in      *bufio.Reader
+	control *bf.Debugger
+}
+
+// runDebugger runs a bf file under the debugger, starting paused before the
+// first op.
+func runDebugger(args []string) {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	compileOpts := compileFlags(flags, bf.MaxOptLevel)
+	inputOpts := inputFlags(flags)
+	filenames := parseInterspersed(flags, args)
+
+	if len(filenames) != 1 {
+		fmt.Print(USAGE)
+		os.Exit(2)
+	}
+	program := loadProgram(filenames[0], compileOpts()...)
+	reader := bufio.NewReader(os.Stdin)
+	d := &debugger{
+		program: program,
+		lines:   strings.Split(program.Source, "\n"),
+		in:      reader,
+		control: bf.NewDebugger(program),
+	}
+	input, closeInput := inputOpts()
+	defer closeInput()
+	opts := append(vmOptions(), bf.WithInput(reader))
+	opts = append(opts, input...)
+	opts = append(opts, bf.WithStepHook(d.hook), bf.WithHistory(debugHistory))
+	d.vm = bf.NewVM(opts...)
+	err := d.vm.Run(program.Ops)
+
+	if errors.Is(err, errQuit) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("\nProgram finished.")
+}
+
+// hook is called before each op runs.  If something should stop the program
+// there, it reads and runs commands until one of them resumes it.
+func (d *debugger) hook(op int) error {
+	stop, ok := d.control.Check(op, d.vm)
+	if !ok {
+		return nil
+	}
+	d.report(stop)
+
+	for {
+		fmt.Print("(bfdb) ")
+		line, err := d.in.ReadString('\n')
+
+		if errors.Is(err, io.EOF) && line == "" {
+			return errQuit
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if resume, err := d.command(d.vm.Op(), fields); err != nil || resume {
+			return err
+		}
+	}
+}
+
+// command runs one command while paused at op, and reports whether the
+// program should carry on.
+func (d *debugger) command(op int, fields []string) (bool, error) {
+	switch fields[0] {
+	case "step", "s":
+		d.control.Step()
+		return true, nil
+	case "next", "n":
+		d.control.Next(op)
+		return true, nil
+	case "finish", "f":
+		if !d.control.Finish(op) {
+			fmt.Println("Not in a loop")
+			return false, nil
+		}
+		return true, nil
+	case "continue", "c":
+		d.control.Continue()
+		return true, nil
+	case "reverse-step", "rs":
+		stop, ok := d.control.ReverseStep(d.vm)
+		if !ok {
+			fmt.Println("No history to go back through")
+			return false, nil
+		}
+		d.report(stop)
+	case "reverse-continue", "rc":
+		stop, ok := d.control.ReverseContinue(d.vm)
+		if !ok {
+			fmt.Println("Reached the start of the history")
+		}
+		d.report(stop)
+	case "break", "b":
+		if len(fields) != 2 {
+			fmt.Println("usage: break LINE:COL | OP")
+			return false, nil
+		}
+		target, err := d.parseBreakpoint(fields[1])
+		if err != nil {
+			fmt.Println(err)
+			return false, nil
+		}
+		d.control.Break(target)
+		fmt.Printf("Breakpoint at op %d\n", target)
+	case "delete", "d":
+		target, err := strconv.Atoi(strings.Join(fields[1:], ""))
+		if err != nil || !d.control.Unbreak(target) {
+			fmt.Println("usage: delete OP, where OP has a breakpoint")
+			return false, nil
+		}
+	case "watch":
+		if len(fields) != 3 || fields[1] != "cell" {
+			fmt.Println("usage: watch cell N")
+			return false, nil
+		}
+		// Any cell can be watched, since with BF_TAPE=grow the tape may not
+		// reach it yet.
+		cell, err := strconv.Atoi(fields[2])
+		if err != nil {
+			fmt.Printf("Not a cell: %s\n", fields[2])
+			return false, nil
+		}
+		d.control.Watch(cell, d.vm.Cell(cell))
+	case "print", "p":
+		start, end, err := d.parseRange(strings.Join(fields[1:], ""))
+		if err != nil {
+			fmt.Println(err)
+			return false, nil
+		}
+		printCells(d.vm, start, end)
+	case "where", "w":
+		d.where(op)
+	case "help", "h":
+		fmt.Print(DEBUG_HELP)
+	case "quit", "q":
+		return false, errQuit
+	default:
+		fmt.Printf("Unknown command %s, try help\n", fields[0])
+	}
+	return false, nil
+}
+
+// report shows where the program stopped, and any watched cells that changed
+// on the way there.
+func (d *debugger) report(stop bf.Stop) {
+	for _, change := range stop.Changed {
+		fmt.Printf("cell %d: %d -> %d\n", change.Cell, change.Old, change.New)
+	}
+	d.where(stop.Op)
+}
+
+// where shows op, the line of source it came from with a caret under where it
+// starts, and the pointer.
+func (d *debugger) where(op int) {
+	o := d.program.Ops[op]
+	pos := bf.Position(o)
+	fmt.Printf("%05d:\t%T%v\t%v\n", op, o, o, pos)
+
+	if pos.Line >= 1 && pos.Line <= len(d.lines) {
+		line := d.lines[pos.Line-1]
+		fmt.Printf("    %s\n    %s^\n", line, bf.CaretIndent(line, pos.Col))
+	}
+	pointer := d.vm.Pointer() - d.vm.Origin()
+	fmt.Printf("ptr %d: [%d]\n", pointer, d.vm.Cell(pointer))
+}
+
+// parseBreakpoint reads a breakpoint's op, given as LINE:COL or as an op
+// number.
+func (d *debugger) parseBreakpoint(arg string) (int, error) {
+	line, col, isPos := strings.Cut(arg, ":")
+	if !isPos {
+		op, err := strconv.Atoi(arg)
+		if err != nil || op < 0 || op >= len(d.program.Ops) {
+			return 0, fmt.Errorf("not an op number: %s", arg)
+		}
+		return op, nil
+	}
+
+	var pos bf.Pos
+	var err1, err2 error
+	pos.Line, err1 = strconv.Atoi(line)
+	pos.Col, err2 = strconv.Atoi(col)
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("not a LINE:COL position: %s", arg)
+	}
+	offset, ok := d.program.Offset(pos)
+	if !ok {
+		return 0, fmt.Errorf("no such position in the source: %v", pos)
+	}
+	op, ok := d.program.OpAt(offset)
+	if !ok {
+		return 0, fmt.Errorf("no code at or after %v", pos)
+	}
+	return op, nil
+}
+
+// cells is the range of cell numbers on the tape so far, counting from the
+// one the program started on.
+func (d *debugger) cells() (int, int) {
+	return -d.vm.Origin(), d.vm.TapeLen() - d.vm.Origin()
+}
+
+// parseRange reads the cells asked for by tape[A:B] or tape[N].  Like Go
+// slices, A and B can be left out.
+func (d *debugger) parseRange(arg string) (int, int, error) {
+	low, high := d.cells()
+	inner, ok := strings.CutPrefix(arg, "tape[")
+	inner, ok2 := strings.CutSuffix(inner, "]")
+	if !ok || !ok2 {
+		return 0, 0, fmt.Errorf("usage: print tape[A:B] or print tape[N]")
+	}
+
+	from, to, isRange := strings.Cut(inner, ":")
+	bound := func(s string, missing int) (int, error) {
+		if s == "" && isRange {
+			return missing, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < low || n > high {
+			return 0, fmt.Errorf("not a cell: %s", s)
+		}
+		return n, nil
+	}
+	start, err := bound(from, low)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		if start == high {
+			return 0, 0, fmt.Errorf("not a cell: %s", from)
+		}
+		return start, start + 1, nil
+	}
+	end, err := bound(to, high)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("empty range: %s", arg)
+	}
+	return start, end, nil
+}
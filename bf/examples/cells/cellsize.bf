@@ -0,0 +1,28 @@
+This works out how wide the cells are: it computes 256 and then 65536 and
+then 4294967296 until one of them wraps around to zero and prints how many
+bits that means; if none of them do the cells must be the widest there are
+which is 64 bits
+
+Cell 0 holds the power of two and cell 1 is used to multiply it
+Cell 2 is set while nothing's been printed yet
+Cells 3 and 4 are for printing
+
+>>+<<
+>++++++++++++++++[<++++++++++++++++>-]<
+[
+    More than 8 bits so multiply by 256
+    [>++++++++++++++++<-]>[<++++++++++++++++>-]<
+    [
+        More than 16 bits so multiply by 65536
+        [>++++++++++++++++<-]>[<++++++++++++++++>-]<
+        [>++++++++++++++++<-]>[<++++++++++++++++>-]<
+        [
+            More than 32 bits so 64
+            >>->>++++++[<++++++++>-]<++++++.--.>++[<-------->-]<----.>++++++++[<++++++++>-]<++.+++++++.+++++++++++.[-]<<<[-]
+        ]
+        >>[->>++++++[<++++++++>-]<+++.-.>++[<-------->-]<--.>++++++++[<++++++++>-]<++.+++++++.+++++++++++.[-]<]<<
+    ]
+    >>[->>++++++[<++++++++>-]<+.+++++.>++[<-------->-]<------.>++++++++[<++++++++>-]<++.+++++++.+++++++++++.[-]<]<<
+]
+>>[->>+++++++[<++++++++>-]<.>+++[<-------->-]<.>++++++++[<++++++++>-]<++.+++++++.+++++++++++.[-]<]<<
+>>>>++++[<++++++++>-]<.>++++++++[<++++++++>-]<+++.++.+++++++..+++++++.>+++++++++++++[<-------->-]<-.[-]
@@ -0,0 +1,4 @@
+A very short Hello World that only works if cells are 8 bits and wrap around
+With wider cells the first loop never finishes
+
++[-->-[>>+>-----<<]<--<---]>-.>>>+.>>..+++[.>]<<<<.+++.------.<<-.>>>>+.
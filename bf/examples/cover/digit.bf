@@ -0,0 +1,6 @@
+Reads a digit and says y if it is 0 and n if it is not
+,>++++++[<-------->-]<   take 48 off it
+>+<                      the next cell is 1 until it is known not to be 0
+[>-<[-]>>+++++++++++[<++++++++++>-]<.[-]<]   not 0: say n
+>[->+++++++++++[<+++++++++++>-]<.[-]]        0: say y
+++++++++++.
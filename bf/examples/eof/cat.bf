@@ -0,0 +1,4 @@
+This copies its input to its output until it reads a zero which is where the
+input ends if reading at the end of input sets the cell to zero
+
+,[.,]
@@ -0,0 +1,21 @@
+This works out what reading at the end of input does: leave the cell alone
+or set it to zero or to minus one and prints unchanged or 0 or minus 1 to match
+
+Cell 0 is read into
+Cell 2 is set while nothing's been printed yet
+Cells 3 and 4 are for printing
+
+>>+<<
++,
+[
+    The cell isn't zero so add one: minus one wraps around to zero and one
+    goes to two
+    +
+    [
+        It was left alone
+        [-]>>->>++++++++++++++[<++++++++>-]<+++++.-------.-----------.+++++.-------.+++++++++++++.-------.--.-.[-]<<<
+    ]
+    >>[->>+++++[<++++++++>-]<+++++.++++.[-]<]<<
+]
+>>[->>++++++[<++++++++>-]<.[-]<]<<
+>>>++++++++++.[-]<<<
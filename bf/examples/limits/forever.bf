@@ -0,0 +1,3 @@
+This never stops: it sets a cell and loops for as long as it's set
+
++[]
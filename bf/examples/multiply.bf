@@ -0,0 +1,12 @@
+Loops that only add to cells nearby and decrement their counter by one are
+compiled to multiplications
+
+++++++++[->+++++++++>+++++++++++++<<]   Set cells one and two to 72 and 104
+>.>+.                                   Print H and i
+<<++++++++++[>>>+++<<<-]                Counter last and cell three = 30
+>>>++.                                  Print a space
+[-<<+>-<<+>>>]                          Multiple terms behind and a factor
+                                        of minus one on cell two
+<.<.<.                                  Print I and h and a space
+>[->+<>-<]                              Terms that cancel out just clear
+>>>++++++++++.                          Newline
@@ -0,0 +1,11 @@
+This uses the cells to the left of where it starts so it only works if the
+tape wraps around or grows to the left
+
+Work out 65 in cell 1 to the left
+++++++++[<++++++++>-]<+
+Move it another cell left and print it
+[<+>-]<.
+Fill the three cells to the left of that then scan left past them
+<+<+<+[<]
+And print a newline from the empty cell the scan stops at
+++++++++++.
@@ -0,0 +1,608 @@
+// Package dap is a Debug Adapter Protocol server for bf programs, so that
+// they can be debugged from editors like VS Code.  It speaks just enough of
+// the protocol for launching a program, line breakpoints, stepping forwards
+// and backwards, and a variables view of the pointer and the tape around it.
+//
+// See https://microsoft.github.io/debug-adapter-protocol/specification
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/rpalo/learning/bf/pkg/bf"
+)
+
+// threadID is the only thread, since bf programs only have the one.
+const threadID = 1
+
+// tapeWindow is how many cells either side of the pointer the variables view
+// shows.
+const tapeWindow = 8
+
+// The variables references: one for the scope with the pointer and the
+// window on the tape, which is all there is.
+const tapeScope = 1
+
+// historyLimit is how many ops back stepping backwards can go.
+const historyLimit = 1 << 20
+
+// errDisconnect stops the program when the client disconnects.
+var errDisconnect = errors.New("disconnected")
+
+// message is any request, response or event.  Only the fields for the
+// message's type are set.
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    *bool           `json:"success,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       any             `json:"body,omitempty"`
+}
+
+// launchArguments are the launch request's arguments, which come from the
+// launch configuration in the editor.
+type launchArguments struct {
+	Program     string `json:"program"`
+	StopOnEntry bool   `json:"stopOnEntry"`
+	NoDebug     bool   `json:"noDebug"`
+	Input       string `json:"input"`    // what the program reads
+	OptLevel    *int   `json:"optLevel"` // default bf.MaxOptLevel
+	TapeSize    int    `json:"tapeSize"` // default 30000
+	CellBits    int    `json:"cellBits"` // 8, 16, 32 or 64 (the default)
+	Tape        string `json:"tape"`     // wrap (the default), error or grow
+	EOF         string `json:"eof"`      // unchanged (the default), 0, -1 or error
+}
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type breakpoint struct {
+	Verified bool    `json:"verified"`
+	Line     int     `json:"line,omitempty"`
+	Column   int     `json:"column,omitempty"`
+	Source   *source `json:"source,omitempty"`
+	Message  string  `json:"message,omitempty"`
+}
+
+type stackFrame struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// Server is one debugging session, for one program.  The program runs on its
+// own goroutine, and the step hook blocks it there while it's paused.
+type Server struct {
+	in      *bufio.Reader
+	out     io.Writer
+	writeMu sync.Mutex // for out and seq
+	seq     int
+
+	program *bf.Program
+	path    string
+	control *bf.Debugger
+	vm      *bf.VM
+	launch  launchArguments
+	started bool
+	ctx     context.Context // cancelled to stop the program
+	cancel  context.CancelFunc
+	resume  chan struct{}
+	done    chan struct{}
+
+	mu      sync.Mutex // for the rest, shared with the program's goroutine
+	paused  bool
+	op      int
+	pausing bool   // a pause request is waiting to take effect
+	back    string // why the last stepBack or reverseContinue stopped
+}
+
+// NewServer creates a server that reads requests from r and writes responses
+// and events to w.
+func NewServer(r io.Reader, w io.Writer) *Server {
+	return &Server{
+		in:     bufio.NewReader(r),
+		out:    w,
+		resume: make(chan struct{}),
+	}
+}
+
+// Serve handles requests until the client disconnects or closes the
+// connection.
+func (s *Server) Serve() error {
+	defer s.stop()
+	for {
+		req, err := s.read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := s.handle(req)
+		s.respond(req, body, err)
+
+		switch req.Command {
+		case "launch":
+			// The client waits for this to send the breakpoints, which need
+			// the program to have been compiled.
+			if err == nil {
+				s.event("initialized", nil)
+			}
+		case "configurationDone":
+			if err == nil {
+				// These are set before the program starts, so that stop
+				// can't see a run that's started but can't yet be cancelled.
+				s.mu.Lock()
+				s.ctx, s.cancel = context.WithCancel(context.Background())
+				s.done = make(chan struct{})
+				s.mu.Unlock()
+				go s.run()
+			}
+		case "stepBack", "reverseContinue":
+			// The program stays paused, just somewhere earlier.
+			if err == nil {
+				s.stopped(s.back)
+			}
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+// handle runs a request and returns the body of its response.
+func (s *Server) handle(req *message) (any, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsStepBack":                 true,
+		}, nil
+	case "launch":
+		return nil, s.launchProgram(req.Arguments)
+	case "setBreakpoints":
+		return s.setBreakpoints(req.Arguments)
+	case "setExceptionBreakpoints":
+		return nil, nil
+	case "configurationDone":
+		if s.program == nil {
+			return nil, errors.New("no program has been launched")
+		}
+		if s.started {
+			return nil, errors.New("the program has already started")
+		}
+		s.started = true
+		return nil, nil
+	case "threads":
+		return map[string]any{
+			"threads": []map[string]any{{"id": threadID, "name": "main"}},
+		}, nil
+	case "stackTrace":
+		return s.stackTrace(), nil
+	case "scopes":
+		return map[string]any{
+			"scopes": []scope{{Name: "Tape", VariablesReference: tapeScope}},
+		}, nil
+	case "variables":
+		return s.variables(), nil
+	case "continue":
+		return map[string]any{"allThreadsContinued": true}, s.resumeWith(func(op int) error {
+			s.control.Continue()
+			return nil
+		})
+	case "next":
+		return nil, s.resumeWith(func(op int) error {
+			s.control.Next(op)
+			return nil
+		})
+	case "stepIn":
+		return nil, s.resumeWith(func(op int) error {
+			s.control.Step()
+			return nil
+		})
+	case "stepOut":
+		return nil, s.resumeWith(func(op int) error {
+			if !s.control.Finish(op) {
+				return errors.New("not in a loop")
+			}
+			return nil
+		})
+	case "stepBack":
+		return s.reverse(func() (bf.Stop, bool) {
+			return s.control.ReverseStep(s.vm)
+		})
+	case "reverseContinue":
+		return s.reverse(func() (bf.Stop, bool) {
+			return s.control.ReverseContinue(s.vm)
+		})
+	case "pause":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.control != nil && !s.paused {
+			s.pausing = true
+			s.control.Step()
+		}
+		return nil, nil
+	case "disconnect":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+// launchProgram compiles the program to debug.  It doesn't start until the
+// configurationDone request, once the breakpoints are set.
+func (s *Server) launchProgram(arguments json.RawMessage) error {
+	if s.program != nil {
+		return errors.New("a program has already been launched")
+	}
+	if err := json.Unmarshal(arguments, &s.launch); err != nil {
+		return err
+	}
+	if s.launch.Program == "" {
+		return errors.New("launch needs a program")
+	}
+	switch s.launch.CellBits {
+	case 0, 8, 16, 32, 64:
+	default:
+		return fmt.Errorf("cellBits must be 8, 16, 32 or 64, got %d", s.launch.CellBits)
+	}
+	policy := bf.TapeWrap
+	if s.launch.Tape != "" {
+		var err error
+		if policy, err = bf.ParseTapePolicy(s.launch.Tape); err != nil {
+			return err
+		}
+	}
+	eof := bf.EOFUnchanged
+	if s.launch.EOF != "" {
+		var err error
+		if eof, err = bf.ParseEOFMode(s.launch.EOF); err != nil {
+			return err
+		}
+	}
+	contents, err := os.ReadFile(s.launch.Program)
+	if err != nil {
+		return err
+	}
+	level := bf.MaxOptLevel
+	if s.launch.OptLevel != nil {
+		level = *s.launch.OptLevel
+	}
+	program, err := bf.Compile(string(contents), bf.WithFilename(s.launch.Program), bf.WithOptLevel(level))
+	if err != nil {
+		return err
+	}
+
+	s.program = program
+	s.path, _ = filepath.Abs(s.launch.Program)
+	s.control = bf.NewDebugger(program)
+	if !s.launch.StopOnEntry {
+		s.control.Continue()
+	}
+	opts := []bf.Option{
+		bf.WithInput(strings.NewReader(s.launch.Input)),
+		bf.WithOutput(&outputWriter{s: s}),
+		bf.WithEOF(eof),
+	}
+	if s.launch.TapeSize > 0 {
+		opts = append(opts, bf.WithTapeSize(s.launch.TapeSize))
+	}
+	if s.launch.CellBits > 0 {
+		opts = append(opts, bf.WithCellBits(s.launch.CellBits))
+	}
+	if policy != bf.TapeWrap {
+		opts = append(opts, bf.WithTapePolicy(policy))
+	}
+	if !s.launch.NoDebug {
+		opts = append(opts, bf.WithStepHook(s.hook), bf.WithHistory(historyLimit))
+	}
+	s.vm = bf.NewVM(opts...)
+	return nil
+}
+
+// setBreakpoints replaces the breakpoints with ones at each line asked for.
+// Each goes on the first op on or after its line, and is moved to the line
+// that op is on.
+func (s *Server) setBreakpoints(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Source      source             `json:"source"`
+		Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	if s.program == nil {
+		return nil, errors.New("breakpoints must be set after launch")
+	}
+
+	s.control.ClearBreakpoints()
+	breakpoints := make([]breakpoint, len(args.Breakpoints))
+	for i, b := range args.Breakpoints {
+		offset, ok := s.program.Offset(bf.Pos{Line: b.Line, Col: 0})
+		op := 0
+		if ok {
+			op, ok = s.program.OpAt(offset)
+		}
+		if !ok {
+			breakpoints[i] = breakpoint{Line: b.Line, Message: "no code on or after this line"}
+			continue
+		}
+		s.control.Break(op)
+		pos := bf.Position(s.program.Ops[op])
+		breakpoints[i] = breakpoint{Verified: true, Line: pos.Line, Column: pos.Col, Source: s.source()}
+	}
+	return map[string]any{"breakpoints": breakpoints}, nil
+}
+
+// resumeWith sets up what the program should do next with f, then lets it
+// carry on, if it's paused.
+func (s *Server) resumeWith(f func(op int) error) error {
+	s.mu.Lock()
+	paused, op := s.paused, s.op
+	s.mu.Unlock()
+	if !paused {
+		return errors.New("the program isn't paused")
+	}
+	if err := f(op); err != nil {
+		return err
+	}
+	s.resume <- struct{}{}
+	return nil
+}
+
+// reverse runs the paused program backwards with f.  The response has no
+// body, so this returns the reason to give for stopping again instead.
+func (s *Server) reverse(f func() (bf.Stop, bool)) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return nil, errors.New("the program isn't paused")
+	}
+	stop, ok := f()
+	if !ok && stop.Reason == "" && s.vm.Op() == s.op {
+		return nil, errors.New("no history to go back through")
+	}
+	s.op, s.back = s.vm.Op(), stopReason(stop.Reason)
+	return nil, nil
+}
+
+// stackTrace is a single frame for the op the program is paused at.
+func (s *Server) stackTrace() any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frames := []stackFrame{}
+	if s.paused {
+		op := s.program.Ops[s.op]
+		pos := bf.Position(op)
+		frames = append(frames, stackFrame{
+			ID:     1,
+			Name:   fmt.Sprintf("%05d: %T%v", s.op, op, op),
+			Source: s.source(),
+			Line:   pos.Line,
+			Column: pos.Col,
+		})
+	}
+	return map[string]any{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+// variables shows the op, the pointer, and the cells around it.
+func (s *Server) variables() any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vars := []variable{}
+	if s.paused {
+		// Cells are numbered from the one the program started on, which
+		// only matters if the tape's grown to the left.
+		origin := s.vm.Origin()
+		pointer := s.vm.Pointer() - origin
+		vars = append(vars,
+			variable{Name: "op", Value: strconv.Itoa(s.op)},
+			variable{Name: "pointer", Value: strconv.Itoa(pointer)},
+		)
+		for i := max(pointer-tapeWindow, -origin); i < min(pointer+tapeWindow+1, s.vm.TapeLen()-origin); i++ {
+			vars = append(vars, variable{Name: fmt.Sprintf("tape[%d]", i), Value: strconv.Itoa(s.vm.Cell(i))})
+		}
+	}
+	return map[string]any{"variables": vars}
+}
+
+func (s *Server) source() *source {
+	return &source{Name: filepath.Base(s.path), Path: s.path}
+}
+
+// run runs the program, then reports that it's done.
+func (s *Server) run() {
+	defer close(s.done)
+	exitCode := 0
+	err := s.vm.RunContext(s.ctx, s.program.Ops)
+	if errors.Is(err, errDisconnect) || errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		s.event("output", map[string]any{"category": "stderr", "output": err.Error() + "\n"})
+		exitCode = 1
+	}
+	s.event("exited", map[string]any{"exitCode": exitCode})
+	s.event("terminated", nil)
+}
+
+// hook is the VM's step hook.  It pauses the program if the Debugger says so,
+// until a request resumes it.
+func (s *Server) hook(op int) error {
+	stop, ok := s.control.Check(op, s.vm)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.paused, s.op = true, op
+	reason := stopReason(stop.Reason)
+	switch {
+	case s.pausing:
+		reason = "pause"
+	case s.launch.StopOnEntry && op == 0 && stop.Reason == bf.StopStep:
+		reason = "entry"
+	}
+	s.pausing = false
+	s.mu.Unlock()
+
+	s.stopped(reason)
+	var err error
+	select {
+	case <-s.resume:
+	case <-s.ctx.Done():
+		err = errDisconnect
+	}
+
+	s.mu.Lock()
+	s.paused = false
+	s.mu.Unlock()
+	return err
+}
+
+// stopReason is the reason the protocol has for a Debugger's.
+func stopReason(reason bf.StopReason) string {
+	switch reason {
+	case bf.StopBreakpoint:
+		return "breakpoint"
+	case bf.StopWatch:
+		return "data breakpoint"
+	}
+	return "step"
+}
+
+// stopped tells the client that the program has paused.
+func (s *Server) stopped(reason string) {
+	s.event("stopped", map[string]any{"reason": reason, "threadId": threadID, "allThreadsStopped": true})
+}
+
+// stop ends the program, if it's running, and waits for it to finish.
+func (s *Server) stop() {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-s.done
+}
+
+// read reads one message: a Content-Length header, a blank line, and that
+// many bytes of JSON.
+func (s *Server) read() (*message, error) {
+	header, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length: %w", err)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(s.in, content); err != nil {
+		return nil, err
+	}
+	var msg message
+	if err := json.Unmarshal(content, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// respond sends the response to req, which failed if err isn't nil.
+func (s *Server) respond(req *message, body any, err error) {
+	success := err == nil
+	msg := &message{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Command:    req.Command,
+		Success:    &success,
+		Body:       body,
+	}
+	if err != nil {
+		msg.Message = err.Error()
+	}
+	s.write(msg)
+}
+
+// event sends an event.
+func (s *Server) event(name string, body any) {
+	s.write(&message{Type: "event", Event: name, Body: body})
+}
+
+func (s *Server) write(msg *message) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.seq++
+	msg.Seq = s.seq
+	content, err := json.Marshal(msg)
+	if err != nil {
+		panic(err) // all of the messages are plain data
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(content), content)
+}
+
+// outputWriter sends what the program writes as output events.  Programs
+// write a byte at a time, and the output is flushed before every op, so a
+// character that's only partly written is held back until the rest of it
+// is, rather than being sent as garbage.
+type outputWriter struct {
+	s       *Server
+	partial []byte
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	buf := append(w.partial, p...)
+	end := len(buf)
+	for i := len(buf) - 1; i >= max(len(buf)-utf8.UTFMax, 0); i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	w.partial = append([]byte(nil), buf[end:]...)
+	if end > 0 {
+		w.s.event("output", map[string]any{"category": "stdout", "output": string(buf[:end])})
+	}
+	return len(p), nil
+}
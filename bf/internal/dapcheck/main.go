@@ -0,0 +1,348 @@
+// dapcheck runs a scripted debugging session against the DAP server, in the
+// same process and connected by pipes, to test it without an editor.  It
+// launches the program, stops on entry, steps, checks the variables, stops at
+// a breakpoint on a line further on, steps back and forwards again, runs
+// backwards to the breakpoint before, then runs the program to the end, failing
+// if the server doesn't answer as an editor would expect.  The program's
+// output, as sent to the client, goes to stdout, so it can be compared with
+// what bf run prints.
+//
+//	go run ./internal/dapcheck prog.bf < prog.in
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rpalo/learning/bf/internal/dap"
+	"github.com/rpalo/learning/bf/pkg/bf"
+)
+
+// message is any message from the server.
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client is the editor's side of the session.
+type client struct {
+	in     *bufio.Reader
+	out    io.Writer
+	seq    int
+	events []*message // events that arrived while waiting for something else
+	output strings.Builder
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) != 2 {
+		log.Fatal("usage: dapcheck FILENAME")
+	}
+	filename := os.Args[1]
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The server compiles the program the same way, so this says where it
+	// should stop.
+	program, err := bf.Compile(string(source))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fromServer, serverOut := io.Pipe()
+	serverIn, toServer := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- dap.NewServer(serverIn, serverOut).Serve()
+		serverOut.Close()
+	}()
+	c := &client{in: bufio.NewReader(fromServer), out: toServer}
+
+	c.request("initialize", map[string]any{"adapterID": "bf"}, nil)
+	c.request("launch", map[string]any{
+		"program":     filename,
+		"stopOnEntry": true,
+		"input":       string(input),
+	}, nil)
+	c.waitEvent("initialized")
+
+	c.request("configurationDone", nil, nil)
+	c.expectStop(program, "entry", 0)
+	if len(program.Ops) > 1 {
+		c.request("stepIn", map[string]any{"threadId": 1}, nil)
+		c.expectStop(program, "step", 1)
+		c.checkVariables(1)
+	}
+
+	if run, ok := lineBreakpoint(program, input); ok {
+		op := run[len(run)-1]
+		line := bf.Position(program.Ops[op]).Line
+		var set struct {
+			Breakpoints []struct {
+				Verified bool
+				Line     int
+			}
+		}
+		c.setBreakpoints(filename, []int{line}, &set)
+		if len(set.Breakpoints) != 1 || !set.Breakpoints[0].Verified || set.Breakpoints[0].Line != line {
+			log.Fatalf("breakpoint on line %d wasn't set: %+v", line, set.Breakpoints)
+		}
+		c.request("continue", map[string]any{"threadId": 1}, nil)
+		c.expectStop(program, "breakpoint", op)
+		c.checkVariables(op)
+
+		c.request("stepBack", map[string]any{"threadId": 1}, nil)
+		c.expectStop(program, "step", run[len(run)-2])
+		c.request("stepIn", map[string]any{"threadId": 1}, nil)
+		c.expectStop(program, "step", op)
+		target, reason := reverseTarget(program, run, op)
+		c.request("reverseContinue", map[string]any{"threadId": 1}, nil)
+		c.expectStop(program, reason, target)
+		c.checkVariables(target)
+	}
+
+	// Breakpoints from '#'s stay, and going backwards can mean passing them
+	// again, so keep going until the program exits.
+	c.setBreakpoints(filename, nil, nil)
+	c.request("continue", map[string]any{"threadId": 1}, nil)
+	msg := c.waitEvent("exited", "stopped")
+	for msg.Event == "stopped" {
+		c.request("continue", map[string]any{"threadId": 1}, nil)
+		msg = c.waitEvent("exited", "stopped")
+	}
+	var exited struct{ ExitCode int }
+	c.decode(msg, &exited)
+	if exited.ExitCode != 0 {
+		log.Fatalf("exited with %d: %s", exited.ExitCode, c.output.String())
+	}
+	c.waitEvent("terminated")
+	c.request("disconnect", nil, nil)
+	toServer.Close()
+	if err := <-served; err != nil {
+		log.Fatal(err)
+	}
+
+	os.Stdout.WriteString(c.output.String())
+}
+
+// errFound stops the run in lineBreakpoint once it's found its op.
+var errFound = errors.New("found")
+
+// lineBreakpoint finds an op to test a line breakpoint with: the first op run
+// after the first two that is also the op a breakpoint on its line goes on.
+// Single-line programs don't have one, since their line's op is op 0.  It
+// returns the ops run up to and including that one.
+func lineBreakpoint(program *bf.Program, input []byte) ([]int, bool) {
+	run := []int{}
+	hook := func(op int) error {
+		run = append(run, op)
+		if len(run) <= 2 {
+			return nil
+		}
+		offset, _ := program.Offset(bf.Pos{Line: bf.Position(program.Ops[op]).Line, Col: 0})
+		if first, ok := program.OpAt(offset); ok && first == op {
+			return errFound
+		}
+		return nil
+	}
+	vm := bf.NewVM(bf.WithInput(bytes.NewReader(input)), bf.WithOutput(io.Discard), bf.WithStepHook(hook))
+	return run, errors.Is(vm.Run(program.Ops), errFound)
+}
+
+// reverseTarget is where running backwards from the end of run should stop:
+// the last op before it with a breakpoint, either op or one from a '#', or
+// the start.
+func reverseTarget(program *bf.Program, run []int, op int) (int, string) {
+	marks := map[int]bool{}
+	for i, c := range program.Source {
+		if mark, ok := program.OpAt(i); ok && c == '#' {
+			marks[mark] = true
+		}
+	}
+	for j := len(run) - 2; j >= 0; j-- {
+		if run[j] == op || marks[run[j]] {
+			return run[j], "breakpoint"
+		}
+	}
+	return 0, "step"
+}
+
+// request sends a request and waits for its response, decoding the body into
+// body if it isn't nil.  Any failure is fatal.
+func (c *client) request(command string, arguments any, body any) {
+	c.seq++
+	content, err := json.Marshal(map[string]any{
+		"seq":       c.seq,
+		"type":      "request",
+		"command":   command,
+		"arguments": arguments,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(c.out, "Content-Length: %d\r\n\r\n%s", len(content), content)
+
+	for {
+		msg := c.read()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.RequestSeq != c.seq || msg.Command != command {
+			log.Fatalf("expected the response to %s, got %+v", command, msg)
+		}
+		if !msg.Success {
+			log.Fatalf("%s failed: %s", command, msg.Message)
+		}
+		if body != nil {
+			c.decode(msg, body)
+		}
+		return
+	}
+}
+
+func (c *client) setBreakpoints(path string, lines []int, body any) {
+	breakpoints := []map[string]any{}
+	for _, line := range lines {
+		breakpoints = append(breakpoints, map[string]any{"line": line})
+	}
+	c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": path},
+		"breakpoints": breakpoints,
+	}, body)
+}
+
+// waitEvent waits for any of the named events, skipping any others.
+func (c *client) waitEvent(names ...string) *message {
+	for len(c.events) > 0 {
+		msg := c.events[0]
+		c.events = c.events[1:]
+		if slices.Contains(names, msg.Event) {
+			return msg
+		}
+	}
+	for {
+		msg := c.read()
+		if msg.Type == "event" && slices.Contains(names, msg.Event) {
+			return msg
+		}
+		if msg.Type == "response" {
+			log.Fatalf("expected a %s event, got a response to %s", strings.Join(names, " or "), msg.Command)
+		}
+	}
+}
+
+// expectStop waits for the program to stop for reason and checks that the
+// stack trace is for op.
+func (c *client) expectStop(program *bf.Program, reason string, op int) {
+	var stopped struct{ Reason string }
+	c.decode(c.waitEvent("stopped"), &stopped)
+	if stopped.Reason != reason {
+		log.Fatalf("expected to stop for %s, stopped for %s", reason, stopped.Reason)
+	}
+
+	var trace struct {
+		StackFrames []struct {
+			Name   string
+			Line   int
+			Column int
+		}
+	}
+	c.request("stackTrace", map[string]any{"threadId": 1}, &trace)
+	if len(trace.StackFrames) != 1 {
+		log.Fatalf("expected one stack frame, got %+v", trace.StackFrames)
+	}
+	frame := trace.StackFrames[0]
+	at, err := strconv.Atoi(strings.SplitN(frame.Name, ":", 2)[0])
+	if err != nil || at != op {
+		log.Fatalf("expected to stop at op %d, stopped at %q", op, frame.Name)
+	}
+	if pos := bf.Position(program.Ops[op]); frame.Line != pos.Line || frame.Column != pos.Col {
+		log.Fatalf("frame for op %d is at %d:%d, not %v", op, frame.Line, frame.Column, pos)
+	}
+}
+
+// checkVariables checks that the variables view has the op, the pointer, and
+// the cell it points at.
+func (c *client) checkVariables(op int) {
+	var scopes struct {
+		Scopes []struct{ VariablesReference int }
+	}
+	c.request("scopes", map[string]any{"frameId": 1}, &scopes)
+	if len(scopes.Scopes) == 0 {
+		log.Fatal("no scopes")
+	}
+	var vars struct {
+		Variables []struct{ Name, Value string }
+	}
+	c.request("variables", map[string]any{"variablesReference": scopes.Scopes[0].VariablesReference}, &vars)
+	values := map[string]string{}
+	for _, v := range vars.Variables {
+		values[v.Name] = v.Value
+	}
+	if values["op"] != strconv.Itoa(op) {
+		log.Fatalf("the op variable is %q, not %d", values["op"], op)
+	}
+	pointer, ok := values["pointer"]
+	if !ok {
+		log.Fatal("no pointer variable")
+	}
+	if _, ok := values["tape["+pointer+"]"]; !ok {
+		log.Fatalf("no variable for the cell at the pointer, %s", pointer)
+	}
+}
+
+// read reads one message, collecting the program's output as it goes.
+func (c *client) read() *message {
+	header, err := textproto.NewReader(c.in).ReadMIMEHeader()
+	if err != nil {
+		log.Fatalf("reading from the server: %v", err)
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		log.Fatalf("bad Content-Length: %v", err)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(c.in, content); err != nil {
+		log.Fatal(err)
+	}
+	var msg message
+	if err := json.Unmarshal(content, &msg); err != nil {
+		log.Fatal(err)
+	}
+	if msg.Type == "event" && msg.Event == "output" {
+		var output struct{ Category, Output string }
+		c.decode(&msg, &output)
+		if output.Category == "stdout" {
+			c.output.WriteString(output.Output)
+		}
+	}
+	return &msg
+}
+
+func (c *client) decode(msg *message, v any) {
+	if err := json.Unmarshal(msg.Body, v); err != nil {
+		log.Fatalf("decoding %s%s: %v", msg.Command, msg.Event, err)
+	}
+}
@@ -0,0 +1,257 @@
+// watrun runs a module written by bf emit-wat, with stdin and stdout hooked up
+// to its read and write imports.  It's only meant for testing the WAT backend
+// without a real WebAssembly runtime, so it understands just the instructions
+// the backend uses, and nothing about the binary format at all.
+//
+//	bf emit-wat prog.bf > prog.wat && go run ./internal/watrun prog.wat
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// instr is one parsed instruction.  arg is a constant, a local's index, or
+// the index of the instruction to jump to, depending on the op.
+type instr struct {
+	op  string
+	arg int64
+}
+
+// label is where a block or loop starts and ends.
+type label struct {
+	loop       bool
+	start, end int
+}
+
+type module struct {
+	pages  int
+	code   []instr
+	locals map[string]int
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) != 2 {
+		log.Fatal("usage: watrun FILENAME")
+	}
+	source, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := parse(string(source))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if op, ok := m.run(in, out); !ok {
+		out.Flush()
+		log.Fatalf("reading input at op %d: EOF", op)
+	}
+}
+
+// parse reads the memory size and the body of the run function.
+func parse(source string) (*module, error) {
+	m := &module{locals: map[string]int{}}
+	labels := map[string]*label{}
+	open := []*label{}
+	inBody := false
+
+	for n, line := range strings.Split(source, "\n") {
+		if i := strings.Index(line, ";;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "(memory":
+			pages, err := strconv.Atoi(strings.TrimSuffix(fields[len(fields)-1], ")"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad memory size", n+1)
+			}
+			m.pages = pages
+			continue
+		case fields[0] == "(local":
+			m.locals[fields[1]] = len(m.locals)
+			inBody = true
+			continue
+		case !inBody || fields[0] == ")":
+			continue
+		}
+
+		in := instr{op: fields[0]}
+		switch in.op {
+		case "block", "loop":
+			l := &label{loop: in.op == "loop", start: len(m.code)}
+			labels[fields[1]] = l
+			open = append(open, l)
+		case "end":
+			if len(open) == 0 {
+				return nil, fmt.Errorf("line %d: unmatched end", n+1)
+			}
+			open[len(open)-1].end = len(m.code)
+			open = open[:len(open)-1]
+		case "local.get", "local.set", "local.tee":
+			index, ok := m.locals[fields[1]]
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown local %s", n+1, fields[1])
+			}
+			in.arg = int64(index)
+		case "call":
+			in.op += " " + fields[1]
+		case "i32.const", "i64.const":
+			value, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			in.arg = value
+		case "br", "br_if":
+			// Resolved below, once every label's end is known.
+			in.op += " " + fields[1]
+		}
+		m.code = append(m.code, in)
+	}
+	if len(open) != 0 {
+		return nil, fmt.Errorf("unclosed block or loop")
+	}
+
+	for i, in := range m.code {
+		op, name, ok := strings.Cut(in.op, " ")
+		if !ok || (op != "br" && op != "br_if") {
+			continue
+		}
+		l, ok := labels[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown label %s", name)
+		}
+		// Branching to a loop goes back to its start; to a block, out of it.
+		target := l.end
+		if l.loop {
+			target = l.start
+		}
+		m.code[i] = instr{op: op, arg: int64(target)}
+	}
+	return m, nil
+}
+
+// run runs the module until it returns.  If it runs out of input, run
+// reports which op asked for it and false.
+func (m *module) run(in *bufio.Reader, out *bufio.Writer) (int, bool) {
+	mem := make([]byte, m.pages*65536)
+	locals := make([]uint64, len(m.locals))
+	stack := []uint64{}
+	push := func(v uint64) { stack = append(stack, v) }
+	pop := func() uint64 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	boolean := func(b bool) uint64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	for pc := 0; pc < len(m.code); pc++ {
+		ins := m.code[pc]
+		switch ins.op {
+		case "block", "loop", "end":
+		case "local.get":
+			push(locals[ins.arg])
+		case "local.set":
+			locals[ins.arg] = pop()
+		case "local.tee":
+			locals[ins.arg] = stack[len(stack)-1]
+		case "i32.const":
+			push(uint64(uint32(ins.arg)))
+		case "i64.const":
+			push(uint64(ins.arg))
+		case "i32.add":
+			b, a := pop(), pop()
+			push(uint64(uint32(a + b)))
+		case "i32.sub":
+			b, a := pop(), pop()
+			push(uint64(uint32(a - b)))
+		case "i64.add":
+			b, a := pop(), pop()
+			push(a + b)
+		case "i32.mul":
+			b, a := pop(), pop()
+			push(uint64(uint32(a * b)))
+		case "i64.mul":
+			b, a := pop(), pop()
+			push(a * b)
+		case "i32.eqz", "i64.eqz":
+			push(boolean(pop() == 0))
+		case "i32.ge_u":
+			b, a := pop(), pop()
+			push(boolean(uint32(a) >= uint32(b)))
+		case "i32.ge_s":
+			b, a := pop(), pop()
+			push(boolean(int32(a) >= int32(b)))
+		case "i64.extend_i32_u":
+		case "i64.extend_i32_s":
+			push(uint64(int64(int32(pop()))))
+		case "select":
+			c, b, a := pop(), pop(), pop()
+			if c != 0 {
+				push(a)
+			} else {
+				push(b)
+			}
+		case "i32.load8_u":
+			push(uint64(mem[pop()]))
+		case "i32.load16_u":
+			push(uint64(binary.LittleEndian.Uint16(mem[pop():])))
+		case "i32.load":
+			push(uint64(binary.LittleEndian.Uint32(mem[pop():])))
+		case "i64.load":
+			push(binary.LittleEndian.Uint64(mem[pop():]))
+		case "i32.store8":
+			v, addr := pop(), pop()
+			mem[addr] = byte(v)
+		case "i32.store16":
+			v, addr := pop(), pop()
+			binary.LittleEndian.PutUint16(mem[addr:], uint16(v))
+		case "i32.store":
+			v, addr := pop(), pop()
+			binary.LittleEndian.PutUint32(mem[addr:], uint32(v))
+		case "i64.store":
+			v, addr := pop(), pop()
+			binary.LittleEndian.PutUint64(mem[addr:], v)
+		case "call $read":
+			c, err := in.ReadByte()
+			if err != nil {
+				push(uint64(uint32(0xFFFFFFFF)))
+			} else {
+				push(uint64(c))
+			}
+		case "call $write":
+			out.WriteByte(byte(pop()))
+		case "call $eof":
+			return int(pop()), false
+		case "return":
+			return 0, true
+		case "br":
+			pc = int(ins.arg)
+		case "br_if":
+			if pop() != 0 {
+				pc = int(ins.arg)
+			}
+		default:
+			log.Fatalf("unsupported instruction %s", ins.op)
+		}
+	}
+	return 0, true
+}
@@ -1,13 +1,22 @@
 package main
 
+// main.go is the command line interface over the bf package in pkg/bf.
+
 import (
-	"bufio"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rpalo/learning/bf/internal/dap"
+	"github.com/rpalo/learning/bf/pkg/bf"
 )
 
 const USAGE = `
@@ -15,14 +24,49 @@ usage: bf COMMAND [ARGS...]
 
 commands:
 	compile FILENAME: compile the bf file at FILENAME and output the ops.
-	run FILENAME: compile the bf file at FILENAME and evaluate
-	repl: Initiate an interactive repl
+	run [-jit] [-input FILE | -input-string STRING] [-max-ops N] [-max-output N]
+		[-timeout DURATION] FILENAME: compile the bf file at FILENAME and
+		evaluate, optionally by compiling it to native code in memory first
+		(Linux x86-64 only), reading input from FILE or STRING instead of stdin,
+		and stopping it after N ops, N bytes of output or DURATION (e.g. 5s).
+		-profile FILE writes a pprof profile of the run to FILE
+	cover [-html] [-o OUTPUT] FILENAME: run the bf file at FILENAME, taking the
+		same input and limit flags as run, and write out its source annotated
+		with how many times each character of it ran, as text or as an HTML
+		heatmap, to OUTPUT (default: FILENAME without .bf, plus .cover.txt or
+		.cover.html).  It's unoptimized, -O0, unless an -O flag says otherwise
+	emit-c FILENAME: compile the bf file at FILENAME and output it as C source
+	emit-asm FILENAME: compile the bf file at FILENAME and output it as x86-64 assembly
+	emit-go FILENAME: compile the bf file at FILENAME and output it as Go source
+	emit-llvm FILENAME: compile the bf file at FILENAME and output it as LLVM IR
+	emit-wat FILENAME: compile the bf file at FILENAME and output it as a WebAssembly
+		text module
+	build FILENAME [-o OUTPUT] [-direct | -via-go]: compile the bf file at FILENAME
+		to an executable, using the system's as and ld (Linux x86-64), writing it
+		directly (Linux x86-64), or by way of Go with the local Go toolchain
+	repl: Initiate an interactive repl that keeps the buffer between lines
+	debug [-input FILE | -input-string STRING] FILENAME: compile the bf file at
+		FILENAME and step through it in an interactive debugger (type help once
+		it starts for its commands)
+	dap: serve the Debug Adapter Protocol over stdin and stdout, for debugging
+		from an editor
+
+Every command that compiles a file also takes optimization flags:
+	-O0, -O1, -O2, -O3: how hard to optimize (default -O3, everything, except
+		for cover)
+	-enable-pass PASS, -disable-pass PASS: run or skip one pass regardless of
+		the level (passes: combine, clear, scan, muladd, offsets)
+	-print-after PASS: print the ops to stderr after PASS runs
 `
 
 var buffer_size = 30000
+var cell_bits = 64
+var tape_policy = bf.TapeWrap
 var debug = false
 var loopcheck = false
-var outputPattern = "%c"
+var eof_mode = bf.EOFUnchanged
+var in_encoding = bf.EncodeBytes
+var out_encoding = bf.EncodeBytes
 
 func init() {
 	if val := os.Getenv("BF_BUFFER_SIZE"); val != "" {
@@ -33,14 +77,53 @@ func init() {
 		}
 		buffer_size = size
 	}
+	if val := os.Getenv("BF_CELL_BITS"); val == "unbounded" {
+		cell_bits = bf.UnboundedCells
+	} else if val != "" {
+		bits, err := strconv.Atoi(val)
+
+		if err != nil {
+			log.Fatalf("Env var BF_CELL_BITS is not an integer or unbounded: %s", val)
+		}
+		switch bits {
+		case 8, 16, 32, 64:
+		default:
+			log.Fatalf("Env var BF_CELL_BITS must be 8, 16, 32, 64 or unbounded: %d", bits)
+		}
+		cell_bits = bits
+	}
+	if val := os.Getenv("BF_TAPE"); val != "" {
+		policy, err := bf.ParseTapePolicy(val)
+
+		if err != nil {
+			log.Fatalf("Env var BF_TAPE: %v", err)
+		}
+		tape_policy = policy
+	}
 	if os.Getenv("BF_DEBUG") != "" {
 		debug = true
 	}
 	if os.Getenv("BF_LOOPCHECK") != "" {
 		loopcheck = true
 	}
+	if val := os.Getenv("BF_EOF"); val != "" {
+		mode, err := bf.ParseEOFMode(val)
+
+		if err != nil {
+			log.Fatalf("Env var BF_EOF: %v", err)
+		}
+		eof_mode = mode
+	}
+	if val := os.Getenv("BF_ENCODING"); val != "" {
+		encoding, err := bf.ParseEncoding(val)
+
+		if err != nil {
+			log.Fatalf("Env var BF_ENCODING: %v", err)
+		}
+		in_encoding, out_encoding = encoding, encoding
+	}
 	if os.Getenv("BF_NUMBERS") != "" {
-		outputPattern = "%d "
+		out_encoding = bf.EncodeNumbers
 	}
 }
 
@@ -51,60 +134,345 @@ func main() {
 	}
 
 	command := os.Args[1]
-	var ops []Opcode
-
-	if len(os.Args) == 3 {
-		bytes_, err := os.ReadFile(os.Args[2])
+	args := os.Args[2:]
 
-		if err != nil {
+	switch command {
+	case "compile":
+		bf.PrintOps(os.Stdout, compileArgs(command, args).Ops)
+	case "run":
+		run(args)
+	case "cover":
+		cover(args)
+	case "emit-c":
+		emit(command, args, bf.EmitC)
+	case "emit-asm":
+		emit(command, args, bf.EmitAsm)
+	case "emit-go":
+		emit(command, args, bf.EmitGo)
+	case "emit-llvm":
+		emit(command, args, bf.EmitLLVM)
+	case "emit-wat":
+		emit(command, args, bf.EmitWAT)
+	case "build":
+		build(args)
+	case "repl":
+		repl()
+	case "debug":
+		runDebugger(args)
+	case "dap":
+		if err := dap.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
 			log.Fatal(err)
 		}
-		contents := string(bytes_)
+	default:
+		fmt.Print(USAGE)
+	}
+}
 
-		ops, err = Compile(contents)
+// run compiles and evaluates a bf file.
+func run(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	jit := flags.Bool("jit", false, "compile to native code in memory and run that")
+	profile := flags.String("profile", "", "write a pprof profile of the run to `FILE`")
+	compileOpts := compileFlags(flags, bf.MaxOptLevel)
+	inputOpts := inputFlags(flags)
+	limitOpts := limitFlags(flags)
+	filenames := parseInterspersed(flags, args)
 
-		if err != nil {
-			log.Fatal(err)
+	if len(filenames) != 1 {
+		fmt.Print(USAGE)
+		os.Exit(2)
+	}
+	program := loadProgram(filenames[0], compileOpts()...)
+	input, closeInput := inputOpts()
+	defer closeInput()
+	opts := append(vmOptions(), input...)
+	opts = append(opts, limitOpts()...)
+	if *jit {
+		opts = append(opts, bf.WithJIT())
+	}
+	var profiler *bf.Profiler
+	if *profile != "" {
+		profiler = bf.NewProfiler(profileInterval)
+		opts = append(opts, bf.WithProfiler(profiler))
+	}
+	vm := bf.NewVM(opts...)
+	// Ctrl-C stops the program the same way as the limits do, saying where.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := vm.RunContext(ctx, program.Ops)
+
+	if loopcheck {
+		bf.PrintLoops(os.Stdout, program.Ops, vm.LoopCounts())
+		fmt.Printf("%d ops run\n", vm.OpCount())
+	}
+	if profiler != nil {
+		writeProfile(*profile, filenames[0], profiler)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// profileInterval is how often bf run -profile samples the op that's running.
+const profileInterval = time.Millisecond
+
+// writeProfile writes the profile of the program in filename to path, and
+// lists the candidate optimizations it found on stderr.
+func writeProfile(path, filename string, profiler *bf.Profiler) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := profiler.WriteProfile(f, filename); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if candidates := profiler.Candidates(); len(candidates) > 0 {
+		fmt.Fprintln(os.Stderr, "Candidate optimizations:")
+		for _, c := range candidates {
+			fmt.Fprintf(os.Stderr, "  %s:%v\n", filename, c)
 		}
 	}
+}
 
-	switch command {
-	case "compile":
-		PrintOps(ops)
-	case "run":
-		EvalBfOps(ops)
-	case "repl":
-		repl()
-	default:
+// cover runs a bf file and writes out which of its code ran, and how often.
+func cover(args []string) {
+	flags := flag.NewFlagSet("cover", flag.ExitOnError)
+	asHTML := flags.Bool("html", false, "write the report as an HTML page instead of text")
+	output := flags.String("o", "", "name of the report (default: FILENAME without .bf, plus .cover.txt or .cover.html)")
+	// Fused loops count as one op each time they're reached, so unless it's
+	// asked for, nothing's optimized, and every character gets its own count.
+	compileOpts := compileFlags(flags, 0)
+	inputOpts := inputFlags(flags)
+	limitOpts := limitFlags(flags)
+	filenames := parseInterspersed(flags, args)
+
+	if len(filenames) != 1 {
 		fmt.Print(USAGE)
+		os.Exit(2)
+	}
+	filename := filenames[0]
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, ".bf") + ".cover.txt"
+		if *asHTML {
+			*output = strings.TrimSuffix(*output, ".txt") + ".html"
+		}
+	}
+	program := loadProgram(filename, compileOpts()...)
+	input, closeInput := inputOpts()
+	defer closeInput()
+	opts := append(vmOptions(), input...)
+	opts = append(opts, limitOpts()...)
+	profiler := bf.NewProfiler(profileInterval)
+	opts = append(opts, bf.WithProfiler(profiler))
+	vm := bf.NewVM(opts...)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// Whatever ran before an error is still worth reporting.
+	err := vm.RunContext(ctx, program.Ops)
+
+	coverage := profiler.Coverage(program)
+	f, createErr := os.Create(*output)
+	if createErr != nil {
+		log.Fatal(createErr)
+	}
+	write := coverage.WriteText
+	if *asHTML {
+		write = coverage.WriteHTML
+	}
+	if err := write(f, filename); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	ran, code := coverage.Covered()
+	fmt.Fprintf(os.Stderr, "%d of %d characters of code ran, see %s\n", ran, code, *output)
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
-// repl interprets bf syntax interactively in a REPL.
-func repl() {
-	reader := bufio.NewReader(os.Stdin)
-	// TODO: make repl remember buffer between lines
+// emit compiles the bf file named in args and writes it out with backend.
+func emit(command string, args []string, backend func(io.Writer, []bf.Opcode, bf.Config) error) {
+	program := compileArgs(command, args)
 
-	for {
-		fmt.Print("bf> ")
-		line, err := reader.ReadString('\n')
+	if err := backend(os.Stdout, program.Ops, config()); err != nil {
+		log.Fatal(err)
+	}
+}
 
-		if errors.Is(err, io.EOF) {
-			return
-		} else if err != nil {
-			log.Fatal(err)
+// compileArgs compiles the bf file named in args, which can also have the
+// optimization flags.
+func compileArgs(command string, args []string) *bf.Program {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	compileOpts := compileFlags(flags, bf.MaxOptLevel)
+	filenames := parseInterspersed(flags, args)
+
+	if len(filenames) != 1 {
+		fmt.Print(USAGE)
+		os.Exit(2)
+	}
+	return loadProgram(filenames[0], compileOpts()...)
+}
+
+// loadProgram reads and compiles the bf file at filename.
+func loadProgram(filename string, opts ...bf.CompileOption) *bf.Program {
+	bytes_, err := os.ReadFile(filename)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append([]bf.CompileOption{bf.WithFilename(filename)}, opts...)
+	program, err := bf.Compile(string(bytes_), opts...)
+
+	var brackets *bf.BracketError
+	if errors.As(err, &brackets) {
+		// These read like a compiler's errors, so they're left as they are.
+		fmt.Fprintln(os.Stderr, brackets)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return program
+}
+
+// config describes the machine asked for by the BF_* env vars, for backends.
+// Compiled programs always wrap around the tape and read and write bytes, so
+// asking for anything else is an error rather than something that quietly
+// doesn't happen.
+func config() bf.Config {
+	if tape_policy != bf.TapeWrap {
+		log.Fatalf("Compiled programs can only wrap around the tape, not BF_TAPE=%v", tape_policy)
+	}
+	if in_encoding != bf.EncodeBytes || out_encoding != bf.EncodeBytes {
+		encoding := in_encoding
+		if encoding == bf.EncodeBytes {
+			encoding = out_encoding
 		}
+		log.Fatalf("Compiled programs can only read and write bytes, not %v", encoding)
+	}
+	return bf.Config{TapeSize: buffer_size, CellBits: cell_bits, EOF: eof_mode}
+}
 
-		line = line[:len(line)-1]
+// vmOptions builds the VM configuration asked for by the BF_* env vars.
+func vmOptions() []bf.Option {
+	opts := []bf.Option{
+		bf.WithTapeSize(buffer_size),
+		bf.WithTapePolicy(tape_policy),
+		bf.WithCellBits(cell_bits),
+		bf.WithEOF(eof_mode),
+		bf.WithInputEncoding(in_encoding),
+		bf.WithOutputEncoding(out_encoding),
+	}
 
-		if len(line) == 0 {
-			return
+	if debug {
+		opts = append(opts, bf.WithTrace(os.Stderr))
+	}
+	if loopcheck {
+		opts = append(opts, bf.WithLoopCounts())
+	}
+	return opts
+}
+
+// limitFlags adds -max-ops, -max-output and -timeout to flags, for stopping
+// programs that go on too long.  The function it returns gives the VM
+// options for them.
+func limitFlags(flags *flag.FlagSet) func() []bf.Option {
+	maxOps := flags.Int("max-ops", 0, "stop the program after it runs `N` ops")
+	maxOutput := flags.Int("max-output", 0, "stop the program before it writes more than `N` bytes")
+	timeout := flags.Duration("timeout", 0, "stop the program after it runs for `DURATION`")
+
+	return func() []bf.Option {
+		return []bf.Option{bf.WithMaxOps(*maxOps), bf.WithMaxOutput(*maxOutput), bf.WithTimeout(*timeout)}
+	}
+}
+
+// inputFlags adds -input and -input-string to flags, for reading the
+// program's input from a file or a string instead of stdin.  The function it
+// returns gives the VM option for whichever was used, if either was, and a
+// function that closes the file, for once the program's finished with it.
+func inputFlags(flags *flag.FlagSet) func() ([]bf.Option, func()) {
+	filename := flags.String("input", "", "read the program's input from `FILE`")
+	input := flags.String("input-string", "", "use `STRING` as the program's input")
+
+	return func() ([]bf.Option, func()) {
+		set := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		switch {
+		case set["input"] && set["input-string"]:
+			log.Fatal("-input and -input-string can't be used together")
+		case set["input"]:
+			f, err := os.Open(*filename)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return []bf.Option{bf.WithInput(f)}, func() { f.Close() }
+		case set["input-string"]:
+			return []bf.Option{bf.WithInput(strings.NewReader(*input))}, func() {}
 		}
-		ops, err := Compile(line)
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			EvalBfOps(ops)
+		return nil, func() {}
+	}
+}
+
+// optLevel is a flag like -O2, which sets the optimization level to 2.  Like
+// any bool flag it can be given a value, and -O2=false leaves the level alone.
+type optLevel struct {
+	level *int
+	value int
+}
+
+func (o optLevel) String() string   { return "" }
+func (o optLevel) IsBoolFlag() bool { return true }
+
+func (o optLevel) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on {
+		*o.level = o.value
+	}
+	return nil
+}
+
+// passNames is a flag that can be given more than once, naming a pass each
+// time.
+type passNames []string
+
+func (p *passNames) String() string { return strings.Join(*p, ",") }
+
+func (p *passNames) Set(name string) error {
+	*p = append(*p, name)
+	return nil
+}
+
+// compileFlags adds the optimization flags to flags, with level as the
+// optimization level if none of -O0 to -O3 is given.  The returned function
+// gives the options they ask for, once flags have been parsed.
+func compileFlags(flags *flag.FlagSet, level int) func() []bf.CompileOption {
+	for i := 0; i <= bf.MaxOptLevel; i++ {
+		flags.Var(optLevel{&level, i}, fmt.Sprintf("O%d", i), fmt.Sprintf("optimization level %d", i))
+	}
+	var enable, disable, printAfter passNames
+	flags.Var(&enable, "enable-pass", "run `PASS` whatever the optimization level")
+	flags.Var(&disable, "disable-pass", "skip `PASS` whatever the optimization level")
+	flags.Var(&printAfter, "print-after", "print the ops to stderr after `PASS` runs")
+
+	return func() []bf.CompileOption {
+		opts := []bf.CompileOption{bf.WithOptLevel(level)}
+		for _, name := range enable {
+			opts = append(opts, bf.WithPass(name))
+		}
+		for _, name := range disable {
+			opts = append(opts, bf.WithoutPass(name))
+		}
+		for _, name := range printAfter {
+			opts = append(opts, bf.WithPrintAfter(name, os.Stderr))
 		}
+		return opts
 	}
 }
@@ -0,0 +1,27 @@
+// Package bf compiles Brainf*ck source to optimized opcodes and runs them.
+//
+// Most callers only need Run.  Compile and VM are there for anything that
+// wants to hang on to a compiled Program, keep a VM's memory between runs, or
+// look at the opcodes themselves.
+package bf
+
+import (
+	"context"
+	"io"
+)
+
+// Run compiles source and runs it on a fresh VM, reading input from stdin and
+// writing output to stdout, configured with any options.  It stops early if
+// ctx is cancelled or a limit is hit, e.g. to run an untrusted program for at
+// most a second and a million ops:
+//
+//	err := bf.Run(ctx, source, stdin, stdout, bf.WithTimeout(time.Second), bf.WithMaxOps(1_000_000))
+func Run(ctx context.Context, source string, stdin io.Reader, stdout io.Writer, opts ...Option) error {
+	program, err := Compile(source)
+
+	if err != nil {
+		return err
+	}
+	vm := NewVM(append([]Option{WithInput(stdin), WithOutput(stdout)}, opts...)...)
+	return vm.RunContext(ctx, program.Ops)
+}
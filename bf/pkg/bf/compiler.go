@@ -0,0 +1,515 @@
+package bf
+
+// compiler.go contains all the functions for compiling bf code to opcodes
+// and optimizing those opcodes for efficiency.  The optimizations work on a
+// tree of ops, where each loop is a Loop holding its body, and the tree is
+// only flattened out into jumps at the very end.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Pos is a position in bf source.  Lines and columns both start at 1, and
+// columns count characters, not bytes.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// Span is a range of bf source: the bytes from Start up to (not including)
+// End.  Pos is where Start is.
+type Span struct {
+	Start int
+	End   int
+	Pos   Pos
+}
+
+// origin records what source an op came from.  Every opcode embeds one, and
+// ops made by optimizations cover all of the source of the ops they replace.
+type origin struct {
+	span   Span
+	source string
+}
+
+func (o origin) from() origin {
+	return o
+}
+
+// through is the origin that runs from the start of o to the end of last.
+func (o origin) through(last origin) origin {
+	return origin{Span{o.span.Start, last.span.End, o.span.Pos}, o.source}
+}
+
+// sourced is any opcode, all of which know where they came from.
+type sourced interface {
+	from() origin
+}
+
+func originOf(op Opcode) origin {
+	if s, ok := op.(sourced); ok {
+		return s.from()
+	}
+	return origin{}
+}
+
+// Position returns where in the source op starts.
+func Position(op Opcode) Pos {
+	return originOf(op).span.Pos
+}
+
+// SpanOf returns the range of source that op came from.  For ops that
+// optimizations made out of several others, like Transfer, that's all of
+// their source, comments and all.
+func SpanOf(op Opcode) Span {
+	return originOf(op).span
+}
+
+// SnippetOf returns the source that op came from.
+func SnippetOf(op Opcode) string {
+	o := originOf(op)
+	return o.source[o.span.Start:o.span.End]
+}
+
+// Loop runs its body until the current buffer value is 0, checking before
+// each time around.  Loops only exist while a program is being compiled:
+// they're flattened into a pair of jumps for the VM.
+type Loop struct {
+	body  []Opcode
+	open  origin // the '['
+	close origin // the ']'
+}
+
+// from covers the whole loop, brackets and all.
+func (l *Loop) from() origin {
+	return l.open.through(l.close)
+}
+
+// RJump tells the VM to jump "right" to the matching ']' if the current buffer
+// value is 0.
+type RJump struct {
+	target int
+	origin
+}
+
+// Target is the index of the matching LJump.
+func (r *RJump) Target() int {
+	return r.target
+}
+
+// LJump tells the VM to jump "left" to the matching '[' if the current buffer
+// value is not 0.
+type LJump struct {
+	target int
+	origin
+}
+
+// Target is the index of the matching RJump.
+func (l *LJump) Target() int {
+	return l.target
+}
+
+// Add increments the buffer value offset slots from the current one by some
+// amount.
+type Add struct {
+	amount int
+	offset int
+	origin
+}
+
+// Move moves the buffer pointer some amount left or right.
+type Move struct {
+	amount int
+	origin
+}
+
+// Transfer shifts all of the value from one buffer slot to another slot some
+// distance away.
+type Transfer struct {
+	distance int
+	origin
+}
+
+// MulAdd adds the current buffer value, multiplied by a factor, to each of
+// several slots at offsets from the current one, then clears the current slot.
+// Transfer is the special case of a single slot and a factor of one.
+type MulAdd struct {
+	terms []mulTerm
+	origin
+}
+
+// mulTerm is one slot a MulAdd adds to.
+type mulTerm struct {
+	offset int
+	factor int
+}
+
+// Find empty skips forward some number of steps repeatedly until it finds an
+// empty buffer slot
+type FindEmpty struct {
+	step int
+	origin
+}
+
+// Input causes the interpreter to read a character of input from stdin into
+// the buffer slot offset slots from the current one.
+type Input struct {
+	offset int
+	origin
+}
+
+// Output causes the interpreter to write a character of output from the
+// buffer slot offset slots from the current one (using its ascii character
+// value).
+type Output struct {
+	offset int
+	origin
+}
+
+// Clear sets the buffer slot offset slots from the current one to zero.
+type Clear struct {
+	offset int
+	origin
+}
+type Opcode any
+
+// Program is bf source compiled down to optimized opcodes, ready to be run by
+// a VM as many times as needed.  SourceMap has the range of Source that each
+// op came from.
+type Program struct {
+	Source    string
+	Ops       []Opcode
+	SourceMap []Span
+}
+
+// Compile compiles bf source to a Program, optimizing it as much as the
+// options allow (by default, with every pass).
+func Compile(source string, opts ...CompileOption) (*Program, error) {
+	c := newCompileConfig(opts)
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	tree, err := parse(source, c.filename)
+
+	if err != nil {
+		return nil, err
+	}
+	ops := linearize(c.optimize(tree))
+	sourceMap := make([]Span, len(ops))
+	for i, op := range ops {
+		sourceMap[i] = SpanOf(op)
+	}
+	return &Program{Source: source, Ops: ops, SourceMap: sourceMap}, nil
+}
+
+// Offset finds the byte offset of pos in the source.  Positions are counted
+// the way the compiler counts them, where a newline is column 0 of the line
+// after it, so the offset of column 0 is just before the start of a line.
+// For line 1, that's the start of the source.
+func (p *Program) Offset(pos Pos) (int, bool) {
+	if pos == (Pos{Line: 1, Col: 0}) {
+		return 0, true
+	}
+	at := Pos{Line: 1, Col: 0}
+	for i, c := range p.Source {
+		at.Col++
+		if c == '\n' {
+			at.Line++
+			at.Col = 0
+		}
+		if at == pos {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// OpAt finds the op that came from the source at offset or, if none did (it's
+// a comment, say), the first op from the source after it.
+func (p *Program) OpAt(offset int) (int, bool) {
+	next := -1
+	for i, span := range p.SourceMap {
+		if span.Start <= offset && offset < span.End {
+			return i, true
+		}
+		if span.Start > offset && (next < 0 || span.Start < p.SourceMap[next].Start) {
+			next = i
+		}
+	}
+	return next, next >= 0
+}
+
+// parse converts bf source to a tree of ops, one per operation character
+// apart from the brackets, which become Loops.  Anything else is a comment.
+// If there are unmatched brackets, it returns a *BracketError listing them.
+func parse(source, filename string) ([]Opcode, error) {
+	// blocks holds the body of each loop that's still open, innermost last,
+	// under the top level of the program, and opens holds where each of those
+	// loops started.
+	blocks := [][]Opcode{make([]Opcode, 0, len(source))}
+	opens := []origin{}
+	unmatched := []Bracket{}
+	pos := Pos{Line: 1, Col: 0}
+
+	for i, c := range source {
+		pos.Col++
+		if c == '\n' {
+			pos.Line++
+			pos.Col = 0
+		}
+		o := origin{Span{i, i + 1, pos}, source}
+
+		var op Opcode
+		switch c {
+		case '+':
+			op = &Add{amount: 1, origin: o}
+		case '-':
+			op = &Add{amount: -1, origin: o}
+		case '>':
+			op = &Move{amount: 1, origin: o}
+		case '<':
+			op = &Move{amount: -1, origin: o}
+		case ',':
+			op = &Input{origin: o}
+		case '.':
+			op = &Output{origin: o}
+		case '[':
+			blocks = append(blocks, []Opcode{})
+			opens = append(opens, o)
+			continue
+		case ']':
+			if len(opens) == 0 {
+				unmatched = append(unmatched, Bracket{']', pos})
+				continue
+			}
+			op = &Loop{body: blocks[len(blocks)-1], open: opens[len(opens)-1], close: o}
+			blocks = blocks[:len(blocks)-1]
+			opens = opens[:len(opens)-1]
+		default:
+			continue
+		}
+		blocks[len(blocks)-1] = append(blocks[len(blocks)-1], op)
+	}
+
+	for _, open := range opens {
+		unmatched = append(unmatched, Bracket{'[', open.span.Pos})
+	}
+	if len(unmatched) > 0 {
+		return nil, newBracketError(filename, source, unmatched)
+	}
+	return blocks[0], nil
+}
+
+// linearize flattens a tree of ops into the flat ops the VM runs, with each
+// Loop becoming an RJump, its body, and an LJump, each pointing at the other.
+func linearize(tree []Opcode) []Opcode {
+	return appendLinear(make([]Opcode, 0, len(tree)), tree)
+}
+
+func appendLinear(ops []Opcode, tree []Opcode) []Opcode {
+	for _, op := range tree {
+		loop, ok := op.(*Loop)
+		if !ok {
+			ops = append(ops, op)
+			continue
+		}
+		start := len(ops)
+		rjump := &RJump{origin: loop.open}
+		ops = appendLinear(append(ops, rjump), loop.body)
+		rjump.target = len(ops)
+		ops = append(ops, &LJump{target: start, origin: loop.close})
+	}
+	return ops
+}
+
+// mapBlocks calls f on every straight run of ops in a tree (the top level,
+// and each loop's body), from the innermost out, and returns the new tree.
+// Loops count as a single op in the runs around them.
+func mapBlocks(tree []Opcode, f func(block []Opcode) []Opcode) []Opcode {
+	result := make([]Opcode, len(tree))
+	for i, op := range tree {
+		if loop, ok := op.(*Loop); ok {
+			op = &Loop{body: mapBlocks(loop.body, f), open: loop.open, close: loop.close}
+		}
+		result[i] = op
+	}
+	return f(result)
+}
+
+// rewriteLoops replaces each loop in a tree that rewrite returns an op for
+// with that op, and leaves the loop alone if rewrite returns nil.  Loops are
+// rewritten from the innermost out, so rewrite sees a loop's body after its
+// own loops have had their chance.
+func rewriteLoops(tree []Opcode, rewrite func(loop *Loop) Opcode) []Opcode {
+	result := make([]Opcode, len(tree))
+	for i, op := range tree {
+		if loop, ok := op.(*Loop); ok {
+			loop = &Loop{body: rewriteLoops(loop.body, rewrite), open: loop.open, close: loop.close}
+			op = loop
+			if replacement := rewrite(loop); replacement != nil {
+				op = replacement
+			}
+		}
+		result[i] = op
+	}
+	return result
+}
+
+// combineRuns condenses runs of Adds or Moves into a single op, e.g. `+++++`
+// becomes Add{5}.
+func combineRuns(ops []Opcode) []Opcode {
+	result := make([]Opcode, 0, len(ops))
+
+	for _, op := range ops {
+		if len(result) > 0 {
+			switch v := op.(type) {
+			case *Add:
+				if last, ok := result[len(result)-1].(*Add); ok && last.offset == v.offset {
+					result[len(result)-1] = &Add{amount: last.amount + v.amount, offset: v.offset, origin: last.through(v.origin)}
+					continue
+				}
+			case *Move:
+				if last, ok := result[len(result)-1].(*Move); ok {
+					result[len(result)-1] = &Move{amount: last.amount + v.amount, origin: last.through(v.origin)}
+					continue
+				}
+			}
+		}
+		result = append(result, op)
+	}
+	return result
+}
+
+// optimizeClear finds the "clear" idiom, `[-]`, and replaces it with a clear
+// opcode.
+func optimizeClear(loop *Loop) Opcode {
+	if len(loop.body) != 1 {
+		return nil
+	}
+
+	if add, ok := loop.body[0].(*Add); !ok || add.amount != -1 || add.offset != 0 {
+		return nil
+	}
+
+	return &Clear{origin: loop.from()}
+}
+
+// loopEffect works out what a loop with body does each time around, if all
+// it does is add to cells and move: how far it leaves the pointer from where
+// it started, how much it adds to the cell it started on, and what it adds to
+// each of the others, as terms in order of offset.  It reports false if the
+// body does anything else.
+func loopEffect(body []Opcode) (offset, step int, terms []mulTerm, ok bool) {
+	amounts := map[int]int{}
+
+	for _, op := range body {
+		switch v := op.(type) {
+		case *Add:
+			amounts[offset+v.offset] += v.amount
+		case *Move:
+			offset += v.amount
+		default:
+			return 0, 0, nil, false
+		}
+	}
+
+	terms = make([]mulTerm, 0, len(amounts))
+	for offset, factor := range amounts {
+		if offset != 0 && factor != 0 {
+			terms = append(terms, mulTerm{offset, factor})
+		}
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		return terms[i].offset < terms[j].offset
+	})
+	return offset, amounts[0], terms, true
+}
+
+// scanStep reports how far a loop with body moves each time around, if
+// moving is all it does: the "find empty" idiom.
+func scanStep(body []Opcode) (int, bool) {
+	if len(body) != 1 {
+		return 0, false
+	}
+	move, ok := body[0].(*Move)
+	if !ok {
+		return 0, false
+	}
+	return move.amount, true
+}
+
+// optimizeMulAdd finds "balanced" loops, which only add to cells and move
+// around, end up back where they started, and take one off the current cell
+// each time around.  Those run exactly as many times as the current cell's
+// value, so they can be replaced with a multiplication.  It returns a
+// Transfer or Clear instead where one of those does the same job.
+func optimizeMulAdd(loop *Loop) Opcode {
+	offset, step, terms, ok := loopEffect(loop.body)
+	if !ok || offset != 0 || step != -1 {
+		return nil
+	}
+
+	switch {
+	case len(terms) == 0:
+		return &Clear{origin: loop.from()}
+	case len(terms) == 1 && terms[0].factor == 1:
+		return &Transfer{distance: terms[0].offset, origin: loop.from()}
+	}
+	return &MulAdd{terms: terms, origin: loop.from()}
+}
+
+// optimizeFindEmpty finds the "find empty" idiom and replaces it with a findempty
+// opcode.
+func optimizeFindEmpty(loop *Loop) Opcode {
+	step, ok := scanStep(loop.body)
+	if !ok {
+		return nil
+	}
+
+	return &FindEmpty{step: step, origin: loop.from()}
+}
+
+// deferMoves puts off moving the pointer through a straight run of ops.
+// Until the next op that needs the pointer to really be somewhere (a loop, or
+// one of the loop replacements), ops get an offset from where the pointer was
+// instead, and then a single Move catches the pointer up.  So `>+>++<<-`
+// becomes three Adds with offsets 1, 2 and 0, and no Moves at all.
+func deferMoves(ops []Opcode) []Opcode {
+	result := make([]Opcode, 0, len(ops))
+	offset := 0
+	var moved origin // all the Moves that have been put off
+
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *Move:
+			if offset == 0 {
+				moved = v.origin
+			} else {
+				moved = moved.through(v.origin)
+			}
+			offset += v.amount
+		case *Add:
+			result = append(result, &Add{amount: v.amount, offset: offset + v.offset, origin: v.origin})
+		case *Input:
+			result = append(result, &Input{offset: offset + v.offset, origin: v.origin})
+		case *Output:
+			result = append(result, &Output{offset: offset + v.offset, origin: v.origin})
+		case *Clear:
+			result = append(result, &Clear{offset: offset + v.offset, origin: v.origin})
+		default:
+			if offset != 0 {
+				result = append(result, &Move{amount: offset, origin: moved})
+				offset = 0
+			}
+			result = append(result, op)
+		}
+	}
+	if offset != 0 {
+		result = append(result, &Move{amount: offset, origin: moved})
+	}
+	return result
+}
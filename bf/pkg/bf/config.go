@@ -0,0 +1,79 @@
+package bf
+
+// config.go describes the machine that compiled programs run on
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Config describes the machine a program runs on.  The backends that compile
+// opcodes down to other languages use it so that their output behaves the
+// same way the VM does.
+type Config struct {
+	// TapeSize is the number of cells in the memory buffer.  Moving off
+	// either end wraps around to the other.
+	TapeSize int
+	// CellBits is the width of each cell: 8, 16, 32 or 64.  The VM's cells
+	// are Go ints, so 64 matches it.  The VM can also have UnboundedCells,
+	// but nothing that's compiled can.
+	CellBits int
+	// EOF is what an Input op does at the end of input.
+	EOF EOFMode
+}
+
+// DefaultConfig is the same machine that NewVM creates.
+func DefaultConfig() Config {
+	return Config{TapeSize: 30000, CellBits: 64}
+}
+
+// validate checks that the config describes a machine that can be built.
+func (c Config) validate() error {
+	if c.TapeSize <= 0 {
+		return fmt.Errorf("tape size must be positive, got %d", c.TapeSize)
+	}
+	switch c.CellBits {
+	case 8, 16, 32, 64, UnboundedCells:
+	default:
+		return fmt.Errorf("cell width must be 8, 16, 32 or 64 bits, or unbounded, got %d", c.CellBits)
+	}
+	if c.EOF < EOFUnchanged || c.EOF > EOFError {
+		return fmt.Errorf("unknown EOF mode %v", c.EOF)
+	}
+	return nil
+}
+
+// validateCompiled is validate for the backends, whose cells are machine
+// words, so they can't be unbounded.
+func (c Config) validateCompiled() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if c.CellBits == UnboundedCells {
+		return errors.New("compiled programs need cells of a fixed width, not unbounded ones, which only the interpreter can run")
+	}
+	return nil
+}
+
+// wrapOffset converts a pointer offset into the equivalent offset in
+// [0, TapeSize), so that backends only ever have to wrap past the top end of
+// the tape.
+func (c Config) wrapOffset(offset int) int {
+	return ((offset % c.TapeSize) + c.TapeSize) % c.TapeSize
+}
+
+// wrapCell converts an amount to add to a cell into the equivalent unsigned
+// amount that fits in a cell, for backends whose languages insist on it.
+func (c Config) wrapCell(amount int) uint64 {
+	if c.CellBits == 64 {
+		return uint64(amount)
+	}
+	return uint64(amount) & (1<<c.CellBits - 1)
+}
+
+// signedCell is wrapCell, but read back as a signed number, for languages
+// whose constants are signed.
+func (c Config) signedCell(amount int) int64 {
+	shift := 64 - c.CellBits
+	return int64(c.wrapCell(amount)<<shift) >> shift
+}
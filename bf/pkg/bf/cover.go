@@ -0,0 +1,258 @@
+package bf
+
+// cover.go maps how many times each op ran back onto the source, to show
+// which code a run of a program covered.
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strings"
+)
+
+// Coverage is how many times each character of a program's source ran.
+type Coverage struct {
+	Source string
+	// Counts has how many times the character starting at each byte of
+	// Source ran, or -1 if it isn't code.
+	Counts []int64
+}
+
+// Coverage maps the profile of prog back onto its source, through the
+// optimizer's source map.  Code that optimizations made into a single op
+// counts as running as many times as that op did, so a loop that became a
+// MulAdd shows how many times it was reached rather than how many times it
+// went around.  If p hasn't profiled prog, none of it ran.
+func (p *Profiler) Coverage(prog *Program) *Coverage {
+	counts := make([]int64, len(prog.Ops))
+	if p.profiles(prog.Ops) {
+		copy(counts, p.counts)
+	}
+
+	// Each code byte belongs to the op with the smallest span that covers
+	// it, so the Adds that deferMoves left inside a Move's span keep their
+	// own counts.
+	owners := make([]int, len(prog.Source))
+	for b := range owners {
+		owners[b] = -1
+	}
+	for i, span := range prog.SourceMap {
+		for b := span.Start; b < span.End; b++ {
+			if owner := owners[b]; owner < 0 || spanLen(span) < spanLen(prog.SourceMap[owner]) {
+				owners[b] = i
+			}
+		}
+	}
+
+	c := &Coverage{Source: prog.Source, Counts: make([]int64, len(prog.Source))}
+	for b := range c.Counts {
+		c.Counts[b] = -1
+		if isCode(prog.Source[b]) && owners[b] >= 0 {
+			c.Counts[b] = counts[owners[b]]
+		}
+	}
+	for b := range c.Counts {
+		if isCode(prog.Source[b]) && owners[b] < 0 {
+			c.Counts[b] = inheritedCount(prog, owners, counts, b)
+		}
+	}
+	return c
+}
+
+func spanLen(s Span) int {
+	return s.End - s.Start
+}
+
+// isCode reports whether c is one of bf's commands.
+func isCode(c byte) bool {
+	return strings.IndexByte("+-<>,.[]", c) >= 0
+}
+
+// inheritedCount is the count for the code byte at b that no op came from,
+// like the Moves that deferMoves cancelled out.  That code ran as many times
+// as the next op after it, whether that's more of the same straight run, the
+// '[' of the loop it runs before, or the ']' of the loop it's the end of.  At
+// the end of the program, it ran as many times as the op before it, or as the
+// loop before it was entered.
+func inheritedCount(prog *Program, owners []int, counts []int64, b int) int64 {
+	for next := b + 1; next < len(owners); next++ {
+		if owners[next] >= 0 && isCode(prog.Source[next]) {
+			return counts[owners[next]]
+		}
+	}
+	for prev := b - 1; prev >= 0; prev-- {
+		if owners[prev] >= 0 && isCode(prog.Source[prev]) {
+			if ljump, ok := prog.Ops[owners[prev]].(*LJump); ok {
+				return counts[ljump.target]
+			}
+			return counts[owners[prev]]
+		}
+	}
+	return 0
+}
+
+// Covered counts the characters of code, and how many of them ran.
+func (c *Coverage) Covered() (ran, code int) {
+	for _, count := range c.Counts {
+		if count >= 0 {
+			code++
+		}
+		if count > 0 {
+			ran++
+		}
+	}
+	return ran, code
+}
+
+// summary says how much of the code in filename ran.
+func (c *Coverage) summary(filename string) string {
+	ran, code := c.Covered()
+	percent := 100.0
+	if code > 0 {
+		percent = 100 * float64(ran) / float64(code)
+	}
+	return fmt.Sprintf("%s: %d of %d characters of code ran (%.1f%%)", filename, ran, code, percent)
+}
+
+// lines splits the source into lines, without their newlines, along with
+// the byte offset each starts at.
+func (c *Coverage) lines() (lines []string, starts []int) {
+	start := 0
+	for _, line := range strings.SplitAfter(c.Source, "\n") {
+		if line == "" {
+			continue
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+		starts = append(starts, start)
+		start += len(line)
+	}
+	return lines, starts
+}
+
+// heat is the character WriteText marks a character that ran count times
+// with: '#' if it never did, the number of digits in count if it did, and a
+// space if it isn't code.  Tabs stay tabs, so the marks line up.
+func heat(r rune, count int64) rune {
+	switch {
+	case r == '\t':
+		return '\t'
+	case count < 0:
+		return ' '
+	case count == 0:
+		return '#'
+	}
+	digits := len(fmt.Sprint(count))
+	if digits > 9 {
+		return '+'
+	}
+	return rune('0' + digits)
+}
+
+// WriteText writes the source of the program in filename annotated with its
+// coverage.  Each line with code on it has the most times any of it ran in
+// front, and underneath it, a mark under each character of code saying
+// roughly how many times it ran: '#' for never, or else how many digits the
+// count has, so 1 is under 10 times and 3 is under 1000.
+func (c *Coverage) WriteText(w io.Writer, filename string) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, c.summary(filename))
+	fmt.Fprintln(out, "# never ran, 1 ran 1-9 times, 2 ran 10-99 times, and so on")
+	fmt.Fprintln(out)
+
+	lines, starts := c.lines()
+	for n, line := range lines {
+		var marks strings.Builder
+		most := int64(-1)
+		for i, r := range line {
+			count := c.Counts[starts[n]+i]
+			most = max(most, count)
+			marks.WriteRune(heat(r, count))
+		}
+		if most < 0 {
+			fmt.Fprintf(out, "%12s  %s\n", "-", line)
+			continue
+		}
+		fmt.Fprintf(out, "%12d  %s\n", most, line)
+		fmt.Fprintf(out, "%12s  %s\n", "", strings.TrimRight(marks.String(), " \t"))
+	}
+	return out.Flush()
+}
+
+// WriteHTML writes the source of the program in filename as a self-contained
+// HTML page, with each character of code shaded by how many times it ran, on
+// a log scale up to the most any of it ran, and code that never ran in red.
+// Hovering over a character gives its exact count.
+func (c *Coverage) WriteHTML(w io.Writer, filename string) error {
+	out := bufio.NewWriter(w)
+	most := int64(1)
+	for _, count := range c.Counts {
+		most = max(most, count)
+	}
+
+	fmt.Fprintf(out, htmlHeader, html.EscapeString(filename), html.EscapeString(c.summary(filename)))
+	// Characters with the same count go in the same span.
+	for start := 0; start < len(c.Source); {
+		end := start + 1
+		for end < len(c.Source) && c.Counts[end] == c.Counts[start] {
+			end++
+		}
+		text := html.EscapeString(c.Source[start:end])
+		switch count := c.Counts[start]; {
+		case count < 0:
+			fmt.Fprintf(out, `<span class="comment">%s</span>`, text)
+		case count == 0:
+			fmt.Fprintf(out, `<span class="never" title="never ran">%s</span>`, text)
+		default:
+			// Once is the palest, and the most is the darkest.
+			shade := math.Log1p(float64(count-1)) / math.Log1p(float64(most-1))
+			if most == 1 {
+				shade = 0
+			}
+			lightness := 90 - 45*shade
+			class := "ran"
+			if lightness < 60 {
+				class = "ran dark"
+			}
+			times := "times"
+			if count == 1 {
+				times = "time"
+			}
+			fmt.Fprintf(out, `<span class="%s" style="background: hsl(30, 90%%, %.0f%%)" title="ran %d %s">%s</span>`,
+				class, lightness, count, times, text)
+		}
+		start = end
+	}
+	fmt.Fprint(out, htmlFooter)
+	return out.Flush()
+}
+
+// htmlHeader starts the page WriteHTML writes, given the filename and the
+// summary.
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s coverage</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { font-size: 14px; line-height: 1.4; }
+.comment { color: #999; }
+.never { background: #f5b7b1; color: #900; }
+.dark { color: #fff; }
+.legend span { padding: 0 0.5em; }
+</style>
+</head>
+<body>
+<p>%s</p>
+<p class="legend"><span class="never">never ran</span>
+<span style="background: hsl(30, 90%%, 90%%)">ran once</span>
+<span class="dark" style="background: hsl(30, 90%%, 45%%)">ran the most</span>
+<span class="comment">not code</span></p>
+<pre>`
+
+const htmlFooter = `</pre>
+</body>
+</html>
+`
@@ -0,0 +1,220 @@
+package bf
+
+// debugger.go decides when to pause a running program, for debuggers to put
+// an interface on.
+
+import (
+	"sort"
+	"sync"
+)
+
+// StopReason says why a Debugger paused a program.
+type StopReason string
+
+const (
+	StopStep       StopReason = "step" // a step, next or finish is done
+	StopBreakpoint StopReason = "breakpoint"
+	StopWatch      StopReason = "watch" // a watched cell changed
+)
+
+// Stop describes a pause.
+type Stop struct {
+	Op      int
+	Reason  StopReason
+	Changed []CellChange // watched cells that changed (or going backwards, that Op changes), by cell
+}
+
+// CellChange is a watched cell's change in value.
+type CellChange struct {
+	Cell int
+	Old  int
+	New  int
+}
+
+// Debugger keeps track of breakpoints, watched cells, and what the program
+// was last told to do, and uses them to decide when it should pause.  Call
+// Check from a VM's step hook (see WithStepHook), and block there while
+// paused.  A Debugger is safe to use from more than one goroutine, so the
+// breakpoints can be changed while the program is running.
+type Debugger struct {
+	mu          sync.Mutex
+	program     *Program
+	stepping    bool // pause before the next op
+	stopAt      int  // pause when this op is reached, or -1
+	breakpoints map[int]bool
+	marks       map[int]bool // the ops at each '#' in the source
+	watches     map[int]int  // watched cells (see VM.Cell) and the value they had last
+}
+
+// NewDebugger creates a Debugger for program that pauses before the first
+// op, with a breakpoint at every '#' in the source.
+func NewDebugger(program *Program) *Debugger {
+	d := &Debugger{
+		program:     program,
+		stepping:    true,
+		stopAt:      -1,
+		breakpoints: make(map[int]bool),
+		marks:       make(map[int]bool),
+		watches:     make(map[int]int),
+	}
+	for i, c := range program.Source {
+		if c != '#' {
+			continue
+		}
+		if op, ok := program.OpAt(i); ok {
+			d.marks[op] = true
+		}
+	}
+	return d
+}
+
+// Check reports whether the program should pause before running op, given
+// the state vm is in now, and why.
+func (d *Debugger) Check(op int, vm *VM) (Stop, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stop := Stop{Op: op}
+	switch {
+	case d.stepping || op == d.stopAt:
+		stop.Reason = StopStep
+	case d.breakpoints[op] || d.marks[op]:
+		stop.Reason = StopBreakpoint
+	}
+	for cell, last := range d.watches {
+		if value := vm.Cell(cell); value != last {
+			stop.Changed = append(stop.Changed, CellChange{cell, last, value})
+			d.watches[cell] = value
+		}
+	}
+	if len(stop.Changed) > 0 {
+		sort.Slice(stop.Changed, func(i, j int) bool {
+			return stop.Changed[i].Cell < stop.Changed[j].Cell
+		})
+		if stop.Reason == "" {
+			stop.Reason = StopWatch
+		}
+	}
+	if stop.Reason == "" {
+		return stop, false
+	}
+	d.stepping = false
+	d.stopAt = -1
+	return stop, true
+}
+
+// Step pauses before the next op, whichever it is.  Called while the program
+// is running, it pauses it as soon as possible.
+func (d *Debugger) Step() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stepping = true
+}
+
+// Next is Step, except that if op starts a loop, it runs the whole loop.
+func (d *Debugger) Next(op int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if rjump, ok := d.program.Ops[op].(*RJump); ok {
+		d.stopAt = rjump.target + 1
+	} else {
+		d.stepping = true
+	}
+}
+
+// Finish runs until the innermost loop around op exits.  It reports false,
+// and does nothing, if op isn't in a loop.
+func (d *Debugger) Finish(op int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := op - 1; i >= 0; i-- {
+		if rjump, ok := d.program.Ops[i].(*RJump); ok && rjump.target >= op {
+			d.stopAt = rjump.target + 1
+			return true
+		}
+	}
+	return false
+}
+
+// Continue runs until a breakpoint or a watched cell pauses the program.
+func (d *Debugger) Continue() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stepping = false
+	d.stopAt = -1
+}
+
+// Break sets a breakpoint at op.
+func (d *Debugger) Break(op int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints[op] = true
+}
+
+// Unbreak removes the breakpoint at op, and reports whether there was one.
+// Breakpoints from '#'s in the source can't be removed.
+func (d *Debugger) Unbreak(op int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	had := d.breakpoints[op]
+	delete(d.breakpoints, op)
+	return had
+}
+
+// ClearBreakpoints removes every breakpoint set with Break.
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.breakpoints)
+}
+
+// Watch pauses the program whenever cell changes from value.  Cells are
+// numbered from the one the program started on, as for VM.Cell.
+func (d *Debugger) Watch(cell, value int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watches[cell] = value
+}
+
+// ReverseStep undoes the last op vm ran (see VM.ReverseStep), and reports
+// where that leaves it.
+func (d *Debugger) ReverseStep(vm *VM) (Stop, bool) {
+	if !vm.ReverseStep() {
+		return Stop{}, false
+	}
+	d.syncWatches(vm)
+	return Stop{Op: vm.Op(), Reason: StopStep}, true
+}
+
+// ReverseContinue runs vm backwards to just before the last op that changed
+// a watched cell or has a breakpoint, which is the op it stops at.  It needs
+// vm to have been created with WithHistory, and if the history runs out
+// first, it stops at the earliest op it can, and reports false.
+func (d *Debugger) ReverseContinue(vm *VM) (Stop, bool) {
+	d.mu.Lock()
+	watched := make([]int, 0, len(d.watches))
+	for cell := range d.watches {
+		watched = append(watched, cell)
+	}
+	breakAt := func(op int) bool {
+		return d.breakpoints[op] || d.marks[op]
+	}
+	stop, ok := vm.reverseUntil(watched, breakAt)
+	d.mu.Unlock()
+
+	sort.Slice(stop.Changed, func(i, j int) bool {
+		return stop.Changed[i].Cell < stop.Changed[j].Cell
+	})
+	d.syncWatches(vm)
+	return stop, ok
+}
+
+// syncWatches catches the watched cells' values up with the tape, after
+// going backwards, so that Check doesn't see that as a change.
+func (d *Debugger) syncWatches(vm *VM) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for cell := range d.watches {
+		d.watches[cell] = vm.Cell(cell)
+	}
+}
@@ -0,0 +1,212 @@
+package bf
+
+// elf.go writes static x86-64 Linux executables directly, with no assembler
+// or linker involved.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	elfBase       = 0x400000   // where the file is mapped
+	elfBSSBase    = 0x40000000 // where the output buffer and tape live
+	elfHeaderSize = 64
+	elfPhdrSize   = 56
+	elfOutSize    = 4096
+)
+
+var elfEOFMessage = []byte("reading input: EOF\n")
+
+// elfRuntime does I/O with Linux syscalls through helpers at the end of the
+// program.
+type elfRuntime struct {
+	outputFn, inputFn x86Label
+}
+
+func (e *elfRuntime) output(a *x86Asm) {
+	a.call(e.outputFn)
+}
+
+func (e *elfRuntime) input(a *x86Asm, op int) {
+	a.call(e.inputFn)
+}
+
+func (e *elfRuntime) loopBack(a *x86Asm, op int, open x86Label) {
+	a.jcc(condNE, open)
+}
+
+// WriteELF writes a static x86-64 Linux executable equivalent to ops to w.
+// It behaves the same as what EmitAsm produces, but doesn't need as or ld.
+func WriteELF(w io.Writer, ops []Opcode, config Config) error {
+	if err := config.validateCompiled(); err != nil {
+		return err
+	}
+	// The EOF message goes right after the headers, and the code after that.
+	messageAddr := int64(elfBase + elfHeaderSize + 2*elfPhdrSize)
+	tapeAddr := int64(elfBSSBase + elfOutSize)
+
+	a := &x86Asm{}
+	rt := &elfRuntime{outputFn: a.newLabel(), inputFn: a.newLabel()}
+	flush := a.newLabel()
+
+	a.movRegImm(tapeReg, tapeAddr)
+	a.movRegImm(outBufReg, elfBSSBase)
+	a.zeroReg(pointerReg)
+	a.zeroReg(outLenReg)
+	if err := lowerOps(a, ops, config, rt); err != nil {
+		return err
+	}
+	a.call(flush)
+	elfExit(a, 0)
+
+	// output appends the byte at [rsi] to the buffer, flushing it when full.
+	a.place(rt.outputFn)
+	a.loadZeroExtend(1, rax, x86Mem{base: rsi, index: noIndex})
+	a.movMemReg(1, x86Mem{base: outBufReg, index: outLenReg, scale: 1}, rax)
+	a.incReg(outLenReg)
+	a.cmpRegImm(outLenReg, elfOutSize)
+	a.jcc(condAE, flush)
+	a.ret()
+
+	// flush writes out whatever is in the buffer.
+	done := a.newLabel()
+	a.place(flush)
+	a.testReg(outLenReg)
+	a.jcc(condE, done)
+	a.push(rsi)
+	elfSyscall(a, 1, 1)
+	a.movRegReg(rsi, outBufReg)
+	a.movRegReg(rdx, outLenReg)
+	a.syscall()
+	a.pop(rsi)
+	a.zeroReg(outLenReg)
+	a.place(done)
+	a.ret()
+
+	// input flushes output, then reads a byte into the cell at [rsi],
+	// zero extending it to the cell's width.  A failed read leaves the
+	// cell alone, so the end of input only needs handling for the other
+	// EOF modes.
+	width := config.CellBits / 8
+	cell := x86Mem{base: rsi, index: noIndex}
+	eof := a.newLabel()
+	a.place(rt.inputFn)
+	a.call(flush)
+	elfSyscall(a, 0, 0)
+	a.movRegImm(rdx, 1)
+	a.syscall()
+	a.cmpRegImm(rax, 1)
+	a.jcc(condNE, eof)
+	if width > 1 {
+		a.loadZeroExtend(1, rax, cell)
+		a.movMemReg(width, cell, rax)
+	}
+	a.ret()
+	a.place(eof)
+	switch config.EOF {
+	case EOFUnchanged:
+		a.ret()
+	case EOFZero:
+		a.movMemImm(width, cell, 0)
+		a.ret()
+	case EOFMinusOne:
+		a.movMemImm(width, cell, -1)
+		a.ret()
+	default:
+		elfSyscall(a, 1, 2)
+		a.movRegImm(rsi, messageAddr)
+		a.movRegImm(rdx, int64(len(elfEOFMessage)))
+		a.syscall()
+		elfExit(a, 1)
+	}
+
+	if err := a.link(); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	entry := messageAddr + int64(len(elfEOFMessage))
+	fileSize := uint64(entry - elfBase + int64(len(a.code)))
+	bssSize := uint64(elfOutSize + config.TapeSize*config.CellBits/8)
+
+	header := elfHeader{
+		Ident:     [16]byte{0x7f, 'E', 'L', 'F', 2, 1, 1},
+		Type:      2, // executable
+		Machine:   62,
+		Version:   1,
+		Entry:     uint64(entry),
+		Phoff:     elfHeaderSize,
+		Ehsize:    elfHeaderSize,
+		Phentsize: elfPhdrSize,
+		Phnum:     2,
+	}
+	text := elfProgramHeader{
+		Type:   1, // PT_LOAD
+		Flags:  5, // R+X
+		Vaddr:  elfBase,
+		Paddr:  elfBase,
+		Filesz: fileSize,
+		Memsz:  fileSize,
+		Align:  0x1000,
+	}
+	bss := elfProgramHeader{
+		Type:  1, // PT_LOAD
+		Flags: 6, // R+W
+		Vaddr: elfBSSBase,
+		Paddr: elfBSSBase,
+		Memsz: bssSize,
+		Align: 0x1000,
+	}
+	binary.Write(&out, binary.LittleEndian, header)
+	binary.Write(&out, binary.LittleEndian, text)
+	binary.Write(&out, binary.LittleEndian, bss)
+	out.Write(elfEOFMessage)
+	out.Write(a.code)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// elfSyscall loads the syscall number and first argument.
+func elfSyscall(a *x86Asm, number int64, arg int64) {
+	a.movRegImm(rax, number)
+	a.movRegImm(rdi, arg)
+}
+
+// elfExit exits the process with status.
+func elfExit(a *x86Asm, status int64) {
+	elfSyscall(a, 60, status)
+	a.syscall()
+}
+
+// elfHeader is the ELF64 file header.
+type elfHeader struct {
+	Ident     [16]byte
+	Type      uint16
+	Machine   uint16
+	Version   uint32
+	Entry     uint64
+	Phoff     uint64
+	Shoff     uint64
+	Flags     uint32
+	Ehsize    uint16
+	Phentsize uint16
+	Phnum     uint16
+	Shentsize uint16
+	Shnum     uint16
+	Shstrndx  uint16
+}
+
+// elfProgramHeader is an ELF64 program header, describing one segment.
+type elfProgramHeader struct {
+	Type   uint32
+	Flags  uint32
+	Offset uint64
+	Vaddr  uint64
+	Paddr  uint64
+	Filesz uint64
+	Memsz  uint64
+	Align  uint64
+}
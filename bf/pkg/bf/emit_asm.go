@@ -0,0 +1,250 @@
+package bf
+
+// emit_asm.go contains the x86-64 backend, which lowers opcodes to GNU
+// assembler source for a static Linux executable that doesn't need libc.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The generated program keeps the tape's address in %rbx and the pointer (as
+// a cell index, not an address) in %r12 the whole time it runs.
+const asmPrelude = `	.equ TAPE_SIZE, %d
+	.equ OUT_SIZE, 4096
+
+	.lcomm tape, TAPE_SIZE * %d
+	.lcomm outbuf, OUT_SIZE
+	.lcomm outlen, 8
+
+	.section .rodata
+eofmsg:
+	.ascii "reading input: EOF\n"
+	.equ EOFMSG_LEN, . - eofmsg
+
+	.text
+	.globl _start
+_start:
+	leaq tape(%%rip), %%rbx
+	xorl %%r12d, %%r12d
+
+`
+
+// asmRuntime holds the I/O helpers, apart from the end of bf_input, which
+// depends on the cell width and the EOF mode.  Output is buffered in outbuf
+// and only written when it fills up, before reading input, and at exit.
+const asmRuntime = `
+	call bf_flush
+	movl $60, %eax
+	xorl %edi, %edi
+	syscall
+
+# bf_output appends the byte at (%rsi) to the output buffer.
+bf_output:
+	movq outlen(%rip), %rcx
+	leaq outbuf(%rip), %rdx
+	movb (%rsi), %al
+	movb %al, (%rdx,%rcx)
+	incq %rcx
+	movq %rcx, outlen(%rip)
+	cmpq $OUT_SIZE, %rcx
+	jae bf_flush
+	ret
+
+# bf_flush writes out and empties the output buffer.
+bf_flush:
+	movl $1, %eax
+	movl $1, %edi
+	leaq outbuf(%rip), %rsi
+	movq outlen(%rip), %rdx
+	testq %rdx, %rdx
+	jz 1f
+	syscall
+	movq $0, outlen(%rip)
+1:
+	ret
+
+# bf_input reads a byte into the cell at (%rsi), zero extended to the cell's
+# width.  A failed read leaves the cell alone.
+bf_input:
+	pushq %rsi
+	call bf_flush
+	popq %rsi
+	xorl %eax, %eax
+	xorl %edi, %edi
+	movl $1, %edx
+	syscall
+	cmpq $1, %rax
+	jne 1f
+`
+
+// asmEOFError ends bf_input for EOFError, reporting the end of input the way
+// the VM does, less the op.
+const asmEOFError = `	movl $1, %eax
+	movl $2, %edi
+	leaq eofmsg(%rip), %rsi
+	movl $EOFMSG_LEN, %edx
+	syscall
+	movl $60, %eax
+	movl $1, %edi
+	syscall
+`
+
+// asmCell describes how to address cells of one width.
+type asmCell struct {
+	suffix string // instruction size suffix
+	reg    string // the size of %rax that holds one cell
+	rdx    string // the size of %rdx that holds one cell
+	load   string // loads a cell, zero extended, into %rax
+	mask   uint64 // for trimming immediates down to the cell width
+}
+
+var asmCells = map[int]asmCell{
+	8:  {"b", "%al", "%dl", "movzbq %s, %%rax", 0xff},
+	16: {"w", "%ax", "%dx", "movzwq %s, %%rax", 0xffff},
+	32: {"l", "%eax", "%edx", "movl %s, %%eax", 0xffffffff},
+	64: {"q", "%rax", "%rdx", "movq %s, %%rax", 0xffffffffffffffff},
+}
+
+// asmEmitter holds what's needed to write the instructions for each op.
+type asmEmitter struct {
+	out    bytes.Buffer
+	config Config
+	cell   asmCell
+	scale  int
+}
+
+// EmitAsm writes GNU assembler source for an x86-64 Linux program equivalent
+// to ops to w.  Like EmitC, output is written a byte at a time.
+func EmitAsm(w io.Writer, ops []Opcode, config Config) error {
+	if err := config.validateCompiled(); err != nil {
+		return err
+	}
+	e := &asmEmitter{config: config, cell: asmCells[config.CellBits], scale: config.CellBits / 8}
+	fmt.Fprintf(&e.out, asmPrelude, config.TapeSize, e.scale)
+
+	for i, op := range ops {
+		switch v := op.(type) {
+		case *Add:
+			e.add(e.offset(v.offset), v.amount)
+		case *Move:
+			e.move("%r12", v.amount)
+		case *Output:
+			e.emit("leaq %s, %%rsi", e.offset(v.offset))
+			e.emit("call bf_output")
+		case *Input:
+			e.emit("leaq %s, %%rsi", e.offset(v.offset))
+			e.emit("call bf_input")
+		case *RJump:
+			e.emit("cmp%s $0, %s", e.cell.suffix, e.at("%r12"))
+			e.emit("je .Lclose%d", i)
+			e.label(".Lopen%d", i)
+		case *LJump:
+			e.emit("cmp%s $0, %s", e.cell.suffix, e.at("%r12"))
+			e.emit("jne .Lopen%d", v.target)
+			e.label(".Lclose%d", v.target)
+		case *Clear:
+			e.emit("mov%s $0, %s", e.cell.suffix, e.offset(v.offset))
+		case *Transfer:
+			e.emit(e.cell.load, e.at("%r12"))
+			e.emit("movq %%r12, %%rcx")
+			e.move("%rcx", v.distance)
+			e.emit("add%s %s, %s", e.cell.suffix, e.cell.reg, e.at("%rcx"))
+			e.emit("mov%s $0, %s", e.cell.suffix, e.at("%r12"))
+		case *MulAdd:
+			e.emit(e.cell.load, e.at("%r12"))
+			for _, term := range v.terms {
+				e.emit("movq %%r12, %%rcx")
+				e.move("%rcx", term.offset)
+				e.emit("movabsq $%d, %%rdx", int64(term.factor))
+				e.emit("imulq %%rax, %%rdx")
+				e.emit("add%s %s, %s", e.cell.suffix, e.cell.rdx, e.at("%rcx"))
+			}
+			e.emit("mov%s $0, %s", e.cell.suffix, e.at("%r12"))
+		case *FindEmpty:
+			e.emit("jmp 2f")
+			e.label("1")
+			e.move("%r12", v.step)
+			e.label("2")
+			e.emit("cmp%s $0, %s", e.cell.suffix, e.at("%r12"))
+			e.emit("jne 1b")
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", op, i)
+		}
+	}
+	e.out.WriteString(asmRuntime)
+	if e.scale > 1 {
+		e.emit("movzbq (%%rsi), %%rax")
+		e.emit("mov%s %s, (%%rsi)", e.cell.suffix, e.cell.reg)
+	}
+	e.emit("ret")
+	e.label("1")
+	switch e.config.EOF {
+	case EOFUnchanged:
+		e.emit("ret")
+	case EOFZero:
+		e.emit("mov%s $0, (%%rsi)", e.cell.suffix)
+		e.emit("ret")
+	case EOFMinusOne:
+		e.emit("mov%s $-1, (%%rsi)", e.cell.suffix)
+		e.emit("ret")
+	default:
+		e.out.WriteString(asmEOFError)
+	}
+	_, err := w.Write(e.out.Bytes())
+	return err
+}
+
+// emit writes one instruction.
+func (e *asmEmitter) emit(format string, args ...any) {
+	e.out.WriteByte('\t')
+	fmt.Fprintf(&e.out, format, args...)
+	e.out.WriteByte('\n')
+}
+
+// label writes a label for the next instruction.
+func (e *asmEmitter) label(format string, args ...any) {
+	fmt.Fprintf(&e.out, format, args...)
+	e.out.WriteString(":\n")
+}
+
+// at is the memory operand for the cell at the index held in reg.
+func (e *asmEmitter) at(reg string) string {
+	return fmt.Sprintf("(%%rbx,%s,%d)", reg, e.scale)
+}
+
+// offset is the memory operand for the cell offset cells from the current
+// one, working out its index into %rcx if it's not the current one.
+func (e *asmEmitter) offset(offset int) string {
+	if offset == 0 {
+		return e.at("%r12")
+	}
+	e.emit("movq %%r12, %%rcx")
+	e.move("%rcx", offset)
+	return e.at("%rcx")
+}
+
+// add adds amount to the cell at the memory operand cell.
+func (e *asmEmitter) add(cell string, amount int) {
+	imm := uint64(amount) & e.cell.mask
+	if e.config.CellBits == 64 && int64(imm) != int64(int32(imm)) {
+		// Only 32 bit immediates can be added to memory.
+		e.emit("movabsq $%d, %%rax", int64(imm))
+		e.emit("addq %%rax, %s", cell)
+		return
+	}
+	if e.config.CellBits == 64 {
+		e.emit("addq $%d, %s", int64(imm), cell)
+		return
+	}
+	e.emit("add%s $%d, %s", e.cell.suffix, imm, cell)
+}
+
+// move moves the cell index in reg by amount, wrapping around the tape.
+func (e *asmEmitter) move(reg string, amount int) {
+	e.emit("addq $%d, %s", e.config.wrapOffset(amount), reg)
+	e.emit("leaq -TAPE_SIZE(%s), %%rdx", reg)
+	e.emit("cmpq $TAPE_SIZE, %s", reg)
+	e.emit("cmovaeq %%rdx, %s", reg)
+}
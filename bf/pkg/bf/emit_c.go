@@ -0,0 +1,138 @@
+package bf
+
+// emit_c.go contains the C backend, which transpiles opcodes into a single
+// self-contained C source file.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const cPrelude = `#include <stdint.h>
+#include <stdio.h>
+
+#define TAPE_SIZE %d
+
+typedef %s cell;
+
+static cell tape[TAPE_SIZE];
+
+/* wrap brings a pointer that has moved past the end of the tape back around
+ * to the start.  Offsets are always normalized to [0, TAPE_SIZE) first. */
+static inline size_t wrap(size_t p) {
+	return p >= TAPE_SIZE ? p - TAPE_SIZE : p;
+}
+
+/* input reads a byte from stdin into *c, and reports whether there was one. */
+static int input(cell *c) {
+	int ch;
+	fflush(stdout);
+	if ((ch = getchar()) == EOF) {
+		return 0;
+	}
+	*c = ch;
+	return 1;
+}
+
+/* eof reports running out of input the same way the VM does. */
+static int eof(int op) {
+	fflush(stdout);
+	fprintf(stderr, "reading input at op %%d: EOF\n", op);
+	return 1;
+}
+
+int main(void) {
+	size_t p = 0;
+
+`
+
+const cEpilogue = `
+	fflush(stdout);
+	return 0;
+}
+`
+
+// cCellTypes maps cell widths to C types.  They're unsigned so that
+// overflow wraps instead of being undefined.
+var cCellTypes = map[int]string{
+	8:  "uint8_t",
+	16: "uint16_t",
+	32: "uint32_t",
+	64: "uint64_t",
+}
+
+// EmitC writes a C program equivalent to ops to w.  Input and output are a
+// byte at a time, like the VM's EncodeBytes, so cells outside 0-255 are
+// truncated when they're written.  Running out of input does whatever
+// config.EOF says.
+func EmitC(w io.Writer, ops []Opcode, config Config) error {
+	if err := config.validateCompiled(); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, cPrelude, config.TapeSize, cCellTypes[config.CellBits])
+	depth := 1
+
+	for i, op := range ops {
+		indent := strings.Repeat("\t", depth)
+
+		switch v := op.(type) {
+		case *Add:
+			fmt.Fprintf(&out, "%s%s += %d;\n", indent, cCell(config, v.offset), v.amount)
+		case *Move:
+			fmt.Fprintf(&out, "%sp = wrap(p + %d);\n", indent, config.wrapOffset(v.amount))
+		case *Output:
+			fmt.Fprintf(&out, "%sputchar((unsigned char)%s);\n", indent, cCell(config, v.offset))
+		case *Input:
+			cell := cCell(config, v.offset)
+			switch config.EOF {
+			case EOFUnchanged:
+				fmt.Fprintf(&out, "%sinput(&%s);\n", indent, cell)
+			case EOFZero:
+				fmt.Fprintf(&out, "%sif (!input(&%s)) %s = 0;\n", indent, cell, cell)
+			case EOFMinusOne:
+				fmt.Fprintf(&out, "%sif (!input(&%s)) %s = (cell)-1;\n", indent, cell, cell)
+			default:
+				fmt.Fprintf(&out, "%sif (!input(&%s)) return eof(%d);\n", indent, cell, i)
+			}
+		case *RJump:
+			fmt.Fprintf(&out, "%swhile (tape[p]) {\n", indent)
+			depth++
+		case *LJump:
+			depth--
+			fmt.Fprintf(&out, "%s}\n", strings.Repeat("\t", depth))
+		case *Clear:
+			fmt.Fprintf(&out, "%s%s = 0;\n", indent, cCell(config, v.offset))
+		case *Transfer:
+			fmt.Fprintf(&out, "%stape[wrap(p + %d)] += tape[p];\n", indent, config.wrapOffset(v.distance))
+			fmt.Fprintf(&out, "%stape[p] = 0;\n", indent)
+		case *MulAdd:
+			// The multiplication is done in 64 bits so that narrow cells
+			// aren't promoted to (overflowable) int.
+			fmt.Fprintf(&out, "%s{\n", indent)
+			fmt.Fprintf(&out, "%s\tuint64_t v = tape[p];\n", indent)
+			for _, term := range v.terms {
+				fmt.Fprintf(&out, "%s\ttape[wrap(p + %d)] += (cell)(v * %dull);\n", indent, config.wrapOffset(term.offset), config.wrapCell(term.factor))
+			}
+			fmt.Fprintf(&out, "%s\ttape[p] = 0;\n", indent)
+			fmt.Fprintf(&out, "%s}\n", indent)
+		case *FindEmpty:
+			fmt.Fprintf(&out, "%swhile (tape[p]) p = wrap(p + %d);\n", indent, config.wrapOffset(v.step))
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", op, i)
+		}
+	}
+	out.WriteString(cEpilogue)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// cCell is the C expression for the cell offset cells from the current one.
+func cCell(config Config, offset int) string {
+	if offset == 0 {
+		return "tape[p]"
+	}
+	return fmt.Sprintf("tape[wrap(p + %d)]", config.wrapOffset(offset))
+}
@@ -0,0 +1,142 @@
+package bf
+
+// emit_go.go contains the Go backend, which transpiles opcodes into a single
+// self-contained Go program.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const goPrelude = `// Code generated by bf emit-go. DO NOT EDIT.
+
+package main
+
+import (
+	"bufio"
+%s	"os"
+)
+
+const tapeSize = %d
+
+type cell = %s
+
+var (
+	in  = bufio.NewReader(os.Stdin)
+	out = bufio.NewWriter(os.Stdout)
+)
+
+// wrap brings a pointer that has moved past the end of the tape back around
+// to the start.  Offsets are always normalized to [0, tapeSize) first.
+func wrap(p int) int {
+	if p >= tapeSize {
+		return p - tapeSize
+	}
+	return p
+}
+
+// input reads a byte from stdin into *c, for the Input op at index op.
+func input(op int, c *cell) {
+	out.Flush()
+	b, err := in.ReadByte()
+	if err != nil {
+%s	}
+	*c = cell(b)
+}
+
+func main() {
+	run(make([]cell, tapeSize), 0)
+	out.Flush()
+}
+
+func run(tape []cell, p int) {
+`
+
+const goEpilogue = `}
+`
+
+// goCellTypes maps cell widths to Go types.
+var goCellTypes = map[int]string{
+	8:  "byte",
+	16: "uint16",
+	32: "uint32",
+	64: "uint64",
+}
+
+// goEOF is what input does at the end of input, for each EOF mode.  Only
+// reporting an error needs fmt, so goImport imports it just for that.
+var goEOF = map[EOFMode]string{
+	EOFError:     "\t\tfmt.Fprintf(os.Stderr, \"reading input at op %d: EOF\\n\", op)\n\t\tos.Exit(1)\n",
+	EOFUnchanged: "\t\treturn\n",
+	EOFZero:      "\t\t*c = 0\n\t\treturn\n",
+	EOFMinusOne:  "\t\t*c = ^cell(0)\n\t\treturn\n",
+}
+
+var goImport = map[EOFMode]string{
+	EOFError: "\t\"fmt\"\n",
+}
+
+// EmitGo writes a Go program equivalent to ops to w.  Like the C backend,
+// output is written a byte at a time.
+func EmitGo(w io.Writer, ops []Opcode, config Config) error {
+	if err := config.validateCompiled(); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, goPrelude, goImport[config.EOF], config.TapeSize, goCellTypes[config.CellBits], goEOF[config.EOF])
+	depth := 1
+
+	for i, op := range ops {
+		indent := strings.Repeat("\t", depth)
+
+		switch v := op.(type) {
+		case *Add:
+			// Go won't let a constant overflow the cell type, so the amount
+			// is wrapped to the cell's width here instead.
+			fmt.Fprintf(&out, "%s%s += %d\n", indent, goCell(config, v.offset), config.wrapCell(v.amount))
+		case *Move:
+			fmt.Fprintf(&out, "%sp = wrap(p + %d)\n", indent, config.wrapOffset(v.amount))
+		case *Output:
+			fmt.Fprintf(&out, "%sout.WriteByte(byte(%s))\n", indent, goCell(config, v.offset))
+		case *Input:
+			fmt.Fprintf(&out, "%sinput(%d, &%s)\n", indent, i, goCell(config, v.offset))
+		case *RJump:
+			fmt.Fprintf(&out, "%sfor tape[p] != 0 {\n", indent)
+			depth++
+		case *LJump:
+			depth--
+			fmt.Fprintf(&out, "%s}\n", strings.Repeat("\t", depth))
+		case *Clear:
+			fmt.Fprintf(&out, "%s%s = 0\n", indent, goCell(config, v.offset))
+		case *Transfer:
+			fmt.Fprintf(&out, "%stape[wrap(p+%d)] += tape[p]\n", indent, config.wrapOffset(v.distance))
+			fmt.Fprintf(&out, "%stape[p] = 0\n", indent)
+		case *MulAdd:
+			fmt.Fprintf(&out, "%sif v := tape[p]; v != 0 {\n", indent)
+			for _, term := range v.terms {
+				fmt.Fprintf(&out, "%s\ttape[wrap(p+%d)] += v * %d\n", indent, config.wrapOffset(term.offset), config.wrapCell(term.factor))
+			}
+			fmt.Fprintf(&out, "%s\ttape[p] = 0\n", indent)
+			fmt.Fprintf(&out, "%s}\n", indent)
+		case *FindEmpty:
+			fmt.Fprintf(&out, "%sfor tape[p] != 0 {\n", indent)
+			fmt.Fprintf(&out, "%s\tp = wrap(p + %d)\n", indent, config.wrapOffset(v.step))
+			fmt.Fprintf(&out, "%s}\n", indent)
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", op, i)
+		}
+	}
+	out.WriteString(goEpilogue)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// goCell is the Go expression for the cell offset cells from the current one.
+func goCell(config Config, offset int) string {
+	if offset == 0 {
+		return "tape[p]"
+	}
+	return fmt.Sprintf("tape[wrap(p+%d)]", config.wrapOffset(offset))
+}
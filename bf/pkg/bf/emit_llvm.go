@@ -0,0 +1,229 @@
+package bf
+
+// emit_llvm.go contains the LLVM backend, which lowers opcodes to textual
+// LLVM IR for clang, llc or lli to optimize and compile further.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The pointer lives in an alloca'd variable rather than in SSA form, so that
+// the IR can be written in one pass.  LLVM's mem2reg pass puts it in a
+// register.
+const llvmPrelude = `@tape = internal global [%[1]d x %[2]s] zeroinitializer
+@eofmsg = private unnamed_addr constant [29 x i8] c"reading input at op %%d: EOF\0A\00"
+
+declare i32 @getchar()
+declare i32 @putchar(i32)
+declare i32 @fflush(i8*)
+declare i32 @dprintf(i32, i8*, ...)
+
+; eof reports running out of input the same way the VM does.
+define internal void @eof(i32 %%op) {
+  call i32 @fflush(i8* null)
+  call i32 (i32, i8*, ...) @dprintf(i32 2, i8* getelementptr ([29 x i8], [29 x i8]* @eofmsg, i64 0, i64 0), i32 %%op)
+  ret void
+}
+
+define i32 @main() {
+entry:
+  %%p = alloca i64
+  store i64 0, i64* %%p
+`
+
+const llvmEpilogue = `  call i32 @fflush(i8* null)
+  ret i32 0
+}
+`
+
+// llvmEmitter holds what's needed to write the instructions for each op.
+type llvmEmitter struct {
+	out    bytes.Buffer
+	config Config
+	cell   string // the cell's integer type
+	tape   string // the tape's array type
+	temps  int
+}
+
+// EmitLLVM writes an LLVM IR module equivalent to ops to w.  It uses getchar
+// and putchar from libc for I/O, so like EmitC, output is written a byte at a
+// time.
+func EmitLLVM(w io.Writer, ops []Opcode, config Config) error {
+	if err := config.validateCompiled(); err != nil {
+		return err
+	}
+	e := &llvmEmitter{config: config, cell: fmt.Sprintf("i%d", config.CellBits)}
+	e.tape = fmt.Sprintf("[%d x %s]", config.TapeSize, e.cell)
+	fmt.Fprintf(&e.out, llvmPrelude, config.TapeSize, e.cell)
+
+	for i, op := range ops {
+		switch v := op.(type) {
+		case *Add:
+			ptr := e.offsetPtr(v.offset)
+			value := e.load(ptr)
+			e.store(e.temp("add %s %s, %d", e.cell, value, e.config.signedCell(v.amount)), ptr)
+		case *Move:
+			e.move(v.amount)
+		case *Output:
+			value := e.load(e.offsetPtr(v.offset))
+			e.emit("call i32 @putchar(i32 %s)", e.toI32(value))
+		case *Input:
+			e.emit("call i32 @fflush(i8* null)")
+			c := e.temp("call i32 @getchar()")
+			atEOF := e.temp("icmp eq i32 %s, -1", c)
+			e.emit("br i1 %s, label %%eof%d, label %%input%d", atEOF, i, i)
+			e.label("eof%d", i)
+			switch e.config.EOF {
+			case EOFUnchanged:
+				e.emit("br label %%read%d", i)
+			case EOFZero:
+				e.store("0", e.offsetPtr(v.offset))
+				e.emit("br label %%read%d", i)
+			case EOFMinusOne:
+				e.store("-1", e.offsetPtr(v.offset))
+				e.emit("br label %%read%d", i)
+			default:
+				e.emit("call void @eof(i32 %d)", i)
+				e.emit("ret i32 1")
+			}
+			e.label("input%d", i)
+			e.store(e.fromI32(c), e.offsetPtr(v.offset))
+			e.emit("br label %%read%d", i)
+			e.label("read%d", i)
+		case *RJump:
+			e.branchIfZero(fmt.Sprintf("close%d", i), fmt.Sprintf("open%d", i))
+			e.label("open%d", i)
+		case *LJump:
+			e.branchIfZero(fmt.Sprintf("close%d", v.target), fmt.Sprintf("open%d", v.target))
+			e.label("close%d", v.target)
+		case *Clear:
+			e.store("0", e.offsetPtr(v.offset))
+		case *Transfer:
+			p := e.pointer()
+			from := e.cellPtr(p)
+			to := e.cellPtr(e.wrap(p, v.distance))
+			sum := e.temp("add %s %s, %s", e.cell, e.load(to), e.load(from))
+			e.store(sum, to)
+			e.store("0", from)
+		case *MulAdd:
+			p := e.pointer()
+			from := e.cellPtr(p)
+			value := e.load(from)
+			for _, term := range v.terms {
+				to := e.cellPtr(e.wrap(p, term.offset))
+				product := e.temp("mul %s %s, %d", e.cell, value, e.config.signedCell(term.factor))
+				e.store(e.temp("add %s %s, %s", e.cell, e.load(to), product), to)
+			}
+			e.store("0", from)
+		case *FindEmpty:
+			e.emit("br label %%find%d", i)
+			e.label("find%d", i)
+			e.branchIfZero(fmt.Sprintf("found%d", i), fmt.Sprintf("step%d", i))
+			e.label("step%d", i)
+			e.move(v.step)
+			e.emit("br label %%find%d", i)
+			e.label("found%d", i)
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", op, i)
+		}
+	}
+	e.out.WriteString(llvmEpilogue)
+	_, err := w.Write(e.out.Bytes())
+	return err
+}
+
+// emit writes one instruction.
+func (e *llvmEmitter) emit(format string, args ...any) {
+	e.out.WriteString("  ")
+	fmt.Fprintf(&e.out, format, args...)
+	e.out.WriteByte('\n')
+}
+
+// temp writes an instruction that produces a value, and returns the name of
+// the value.
+func (e *llvmEmitter) temp(format string, args ...any) string {
+	name := fmt.Sprintf("%%t%d", e.temps)
+	e.temps++
+	e.emit("%s = %s", name, fmt.Sprintf(format, args...))
+	return name
+}
+
+// label starts a new basic block.
+func (e *llvmEmitter) label(format string, args ...any) {
+	fmt.Fprintf(&e.out, format+":\n", args...)
+}
+
+// pointer loads the current pointer.
+func (e *llvmEmitter) pointer() string {
+	return e.temp("load i64, i64* %%p")
+}
+
+// wrap returns the pointer amount cells away from p, wrapping around the
+// tape.
+func (e *llvmEmitter) wrap(p string, amount int) string {
+	size := e.config.TapeSize
+	sum := e.temp("add i64 %s, %d", p, e.config.wrapOffset(amount))
+	over := e.temp("icmp uge i64 %s, %d", sum, size)
+	under := e.temp("sub i64 %s, %d", sum, size)
+	return e.temp("select i1 %s, i64 %s, i64 %s", over, under, sum)
+}
+
+// move moves the pointer amount cells.
+func (e *llvmEmitter) move(amount int) {
+	e.emit("store i64 %s, i64* %%p", e.wrap(e.pointer(), amount))
+}
+
+// cellPtr returns the address of the cell at p.
+func (e *llvmEmitter) cellPtr(p string) string {
+	return e.temp("getelementptr inbounds %s, %s* @tape, i64 0, i64 %s", e.tape, e.tape, p)
+}
+
+// offsetPtr returns the address of the cell offset cells from the current
+// one.
+func (e *llvmEmitter) offsetPtr(offset int) string {
+	p := e.pointer()
+	if offset == 0 {
+		return e.cellPtr(p)
+	}
+	return e.cellPtr(e.wrap(p, offset))
+}
+
+func (e *llvmEmitter) load(ptr string) string {
+	return e.temp("load %s, %s* %s", e.cell, e.cell, ptr)
+}
+
+func (e *llvmEmitter) store(value, ptr string) {
+	e.emit("store %s %s, %s* %s", e.cell, value, e.cell, ptr)
+}
+
+// branchIfZero ends the block by branching to zero if the current cell is
+// zero, and to nonzero otherwise.
+func (e *llvmEmitter) branchIfZero(zero, nonzero string) {
+	value := e.load(e.cellPtr(e.pointer()))
+	isZero := e.temp("icmp eq %s %s, 0", e.cell, value)
+	e.emit("br i1 %s, label %%%s, label %%%s", isZero, zero, nonzero)
+}
+
+// toI32 converts a cell value to the i32 that putchar takes.
+func (e *llvmEmitter) toI32(value string) string {
+	switch {
+	case e.config.CellBits < 32:
+		return e.temp("zext %s %s to i32", e.cell, value)
+	case e.config.CellBits > 32:
+		return e.temp("trunc %s %s to i32", e.cell, value)
+	}
+	return value
+}
+
+// fromI32 converts a byte returned by getchar to a cell value.
+func (e *llvmEmitter) fromI32(value string) string {
+	switch {
+	case e.config.CellBits < 32:
+		return e.temp("trunc i32 %s to %s", value, e.cell)
+	case e.config.CellBits > 32:
+		return e.temp("zext i32 %s to %s", value, e.cell)
+	}
+	return value
+}
@@ -0,0 +1,253 @@
+package bf
+
+// emit_wat.go contains the WebAssembly backend, which compiles opcodes to a
+// module in the WebAssembly text format.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The module imports its I/O from the host:
+//
+//	env.read() -> i32: the next byte of input, or -1 at the end of input
+//	env.write(i32): write a byte of output
+//	env.eof(i32): called with the op's index when an Input op runs out of
+//	    input with EOFError, just before run returns early
+//
+// and exports its memory (the tape) and a run function.
+const watPrelude = `(module
+  (import "env" "read" (func $read (result i32)))
+  (import "env" "write" (func $write (param i32)))
+  (import "env" "eof" (func $eof (param i32)))
+  (memory (export "memory") %d)
+  (func (export "run")
+    (local $p i32)
+    (local $q i32)
+    (local $c i32)
+    (local $v %s)
+`
+
+const watEpilogue = `  )
+)
+`
+
+// watCell describes how to work with cells of one width.  The pointer is
+// kept as a byte address into memory, not a cell index.
+type watCell struct {
+	typ   string // the value type a cell is loaded as
+	load  string
+	store string
+}
+
+var watCells = map[int]watCell{
+	8:  {"i32", "i32.load8_u", "i32.store8"},
+	16: {"i32", "i32.load16_u", "i32.store16"},
+	32: {"i32", "i32.load", "i32.store"},
+	64: {"i64", "i64.load", "i64.store"},
+}
+
+// watEmitter holds what's needed to write the instructions for each op.
+type watEmitter struct {
+	out    bytes.Buffer
+	config Config
+	cell   watCell
+	width  int
+	depth  int
+}
+
+// EmitWAT writes a WebAssembly text module equivalent to ops to w.  Like the
+// other compiled backends, output is written a byte at a time.
+func EmitWAT(w io.Writer, ops []Opcode, config Config) error {
+	if err := config.validateCompiled(); err != nil {
+		return err
+	}
+	e := &watEmitter{config: config, cell: watCells[config.CellBits], width: config.CellBits / 8, depth: 2}
+	tapeBytes := config.TapeSize * e.width
+	fmt.Fprintf(&e.out, watPrelude, (tapeBytes+65535)/65536, e.cell.typ)
+
+	for i, op := range ops {
+		switch v := op.(type) {
+		case *Add:
+			e.comment("Add %d at %d", v.amount, v.offset)
+			addr := e.at(v.offset)
+			e.emit("local.get %s", addr)
+			e.loadCell(addr)
+			e.emit("%s.const %d", e.cell.typ, e.config.signedCell(v.amount))
+			e.emit("%s.add", e.cell.typ)
+			e.emit("%s", e.cell.store)
+		case *Move:
+			e.comment("Move %d", v.amount)
+			e.move("$p", "$p", v.amount)
+		case *Output:
+			e.comment("Output at %d", v.offset)
+			e.emit("local.get %s", e.at(v.offset))
+			e.emit("i32.load8_u")
+			e.emit("call $write")
+		case *Input:
+			e.comment("Input at %d", v.offset)
+			if e.config.EOF == EOFUnchanged {
+				// Skips storing anything at the end of input.
+				e.open("block $n%d", i)
+			}
+			e.open("block $i%d", i)
+			e.emit("call $read")
+			e.emit("local.tee $c")
+			e.emit("i32.const 0")
+			e.emit("i32.ge_s")
+			e.emit("br_if $i%d", i)
+			switch e.config.EOF {
+			case EOFUnchanged:
+				e.emit("br $n%d", i)
+			case EOFZero:
+				e.emit("i32.const 0")
+				e.emit("local.set $c")
+			case EOFMinusOne:
+				e.emit("i32.const -1")
+				e.emit("local.set $c")
+			default:
+				e.emit("i32.const %d", i)
+				e.emit("call $eof")
+				e.emit("return")
+			}
+			e.close()
+			e.emit("local.get %s", e.at(v.offset))
+			e.emit("local.get $c")
+			if e.cell.typ == "i64" {
+				// Signed, so that -1 stays -1.
+				e.emit("i64.extend_i32_s")
+			}
+			e.emit("%s", e.cell.store)
+			if e.config.EOF == EOFUnchanged {
+				e.close()
+			}
+		case *RJump:
+			e.comment("RJump")
+			e.open("block $b%d", i)
+			e.loadCellEqz("$p")
+			e.emit("br_if $b%d", i)
+			e.open("loop $l%d", i)
+		case *LJump:
+			e.comment("LJump")
+			e.loadCellEqz("$p")
+			e.emit("i32.eqz")
+			e.emit("br_if $l%d", v.target)
+			e.close()
+			e.close()
+		case *Clear:
+			e.comment("Clear at %d", v.offset)
+			e.emit("local.get %s", e.at(v.offset))
+			e.emit("%s.const 0", e.cell.typ)
+			e.emit("%s", e.cell.store)
+		case *Transfer:
+			e.comment("Transfer %d", v.distance)
+			e.move("$q", "$p", v.distance)
+			e.emit("local.get $q")
+			e.loadCell("$q")
+			e.loadCell("$p")
+			e.emit("%s.add", e.cell.typ)
+			e.emit("%s", e.cell.store)
+			e.emit("local.get $p")
+			e.emit("%s.const 0", e.cell.typ)
+			e.emit("%s", e.cell.store)
+		case *MulAdd:
+			e.comment("MulAdd %v", v.terms)
+			e.loadCell("$p")
+			e.emit("local.set $v")
+			for _, term := range v.terms {
+				e.move("$q", "$p", term.offset)
+				e.emit("local.get $q")
+				e.loadCell("$q")
+				e.emit("local.get $v")
+				e.emit("%s.const %d", e.cell.typ, e.config.signedCell(term.factor))
+				e.emit("%s.mul", e.cell.typ)
+				e.emit("%s.add", e.cell.typ)
+				e.emit("%s", e.cell.store)
+			}
+			e.emit("local.get $p")
+			e.emit("%s.const 0", e.cell.typ)
+			e.emit("%s", e.cell.store)
+		case *FindEmpty:
+			e.comment("FindEmpty %d", v.step)
+			e.open("block $f%d", i)
+			e.open("loop $g%d", i)
+			e.loadCellEqz("$p")
+			e.emit("br_if $f%d", i)
+			e.move("$p", "$p", v.step)
+			e.emit("br $g%d", i)
+			e.close()
+			e.close()
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", op, i)
+		}
+	}
+	e.out.WriteString(watEpilogue)
+	_, err := w.Write(e.out.Bytes())
+	return err
+}
+
+// emit writes one instruction at the current nesting depth.
+func (e *watEmitter) emit(format string, args ...any) {
+	e.out.WriteString(strings.Repeat("  ", e.depth))
+	fmt.Fprintf(&e.out, format, args...)
+	e.out.WriteByte('\n')
+}
+
+// comment notes which op the following instructions came from.
+func (e *watEmitter) comment(format string, args ...any) {
+	e.emit(";; "+format, args...)
+}
+
+// open starts a block or loop.
+func (e *watEmitter) open(format string, args ...any) {
+	e.emit(format, args...)
+	e.depth++
+}
+
+// close ends the innermost block or loop.
+func (e *watEmitter) close() {
+	e.depth--
+	e.emit("end")
+}
+
+// at returns the local holding the address of the cell offset cells from
+// the current one, working it out into $q if it's not the current one.
+func (e *watEmitter) at(offset int) string {
+	if offset == 0 {
+		return "$p"
+	}
+	e.move("$q", "$p", offset)
+	return "$q"
+}
+
+// loadCell pushes the value of the cell at the address in local.
+func (e *watEmitter) loadCell(local string) {
+	e.emit("local.get %s", local)
+	e.emit("%s", e.cell.load)
+}
+
+// loadCellEqz pushes whether the cell at the address in local is zero.
+func (e *watEmitter) loadCellEqz(local string) {
+	e.loadCell(local)
+	e.emit("%s.eqz", e.cell.typ)
+}
+
+// move sets dst to the address amount cells away from src, wrapping around
+// the tape.
+func (e *watEmitter) move(dst, src string, amount int) {
+	tapeBytes := e.config.TapeSize * e.width
+	e.emit("local.get %s", src)
+	e.emit("i32.const %d", e.config.wrapOffset(amount)*e.width)
+	e.emit("i32.add")
+	e.emit("local.tee %s", dst)
+	e.emit("i32.const %d", tapeBytes)
+	e.emit("i32.sub")
+	e.emit("local.get %s", dst)
+	e.emit("local.get %s", dst)
+	e.emit("i32.const %d", tapeBytes)
+	e.emit("i32.ge_u")
+	e.emit("select")
+	e.emit("local.set %s", dst)
+}
@@ -0,0 +1,153 @@
+package bf
+
+// errors.go contains the errors that compiling and running can report.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UnmatchedBracket is what a *BracketError is, for callers that only care
+// whether the brackets matched.
+var UnmatchedBracket = errors.New("Syntax error: unmatched square bracket")
+
+// Bracket is a '[' or ']' in the source.
+type Bracket struct {
+	Char rune
+	Pos  Pos
+}
+
+// BracketError lists every unmatched bracket in a program, in the order they
+// appear in the source.
+type BracketError struct {
+	Filename string // empty if the source didn't come from a file
+	Brackets []Bracket
+	lines    []string
+}
+
+func newBracketError(filename, source string, brackets []Bracket) *BracketError {
+	sort.Slice(brackets, func(i, j int) bool {
+		a, b := brackets[i].Pos, brackets[j].Pos
+		return a.Line < b.Line || (a.Line == b.Line && a.Col < b.Col)
+	})
+	return &BracketError{
+		Filename: filename,
+		Brackets: brackets,
+		lines:    strings.Split(source, "\n"),
+	}
+}
+
+// Error describes each unmatched bracket like a compiler would, e.g.
+//
+//	file.bf:12:4: unmatched '['
+//	    ++[>+<-
+//	      ^
+func (e *BracketError) Error() string {
+	var b strings.Builder
+	for i, bracket := range e.Brackets {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		if e.Filename != "" {
+			fmt.Fprintf(&b, "%s:", e.Filename)
+		}
+		fmt.Fprintf(&b, "%s: unmatched '%c'", bracket.Pos, bracket.Char)
+		if bracket.Pos.Line <= len(e.lines) {
+			line := strings.TrimRight(e.lines[bracket.Pos.Line-1], "\r")
+			fmt.Fprintf(&b, "\n    %s\n    %s^", line, CaretIndent(line, bracket.Pos.Col))
+		}
+	}
+	return b.String()
+}
+
+// Is makes errors.Is(err, UnmatchedBracket) true for a *BracketError.
+func (e *BracketError) Is(target error) bool {
+	return target == UnmatchedBracket
+}
+
+// TapeError is what a VM with TapeFail or TapeGrow returns when a program
+// goes off the end of its tape.
+type TapeError struct {
+	Op     int // the op's index
+	Opcode Opcode
+	Cell   int  // the cell it reached for, counting from where it started
+	Left   bool // whether it went off the left end, rather than the right
+	Limit  int  // with TapeGrow, how big the tape can get
+}
+
+// Error says which op went off the tape, and where it came from, e.g.
+//
+//	3:1: op 7, *bf.Move{-1} "<", went off the left end of the tape, to cell -1
+func (e *TapeError) Error() string {
+	end := "right"
+	if e.Left {
+		end = "left"
+	}
+	msg := fmt.Sprintf("%v: op %d, %T%v %s, went off the %s end of the tape, to cell %d",
+		Position(e.Opcode), e.Op, e.Opcode, e.Opcode, snippet(e.Opcode), end, e.Cell)
+	if e.Limit > 0 {
+		msg += fmt.Sprintf(", and it can't grow past %d cells", e.Limit)
+	}
+	return msg
+}
+
+// LimitError is what a VM returns when it stops a program before it's
+// finished, because of a limit set with WithMaxOps, WithMaxOutput or
+// WithTimeout, or because its context was cancelled or ran out of time.
+type LimitError struct {
+	Limit   Limit
+	Max     int // for LimitOps and LimitOutput, the limit
+	Op      int // the index of the op it stopped before
+	Opcode  Opcode
+	Ops     int   // how many ops it had run, or -1 in the JIT, which doesn't count them
+	Pointer int   // the cell the pointer was on, counting from where it started
+	Err     error // for LimitTime and LimitCancelled, the context's error
+}
+
+// Error says where the program stopped and why, e.g.
+//
+//	1:4: op 2, *bf.LJump{0} "]", stopped after 1000 ops with the pointer at cell 0: it can only run 1000 ops
+func (e *LimitError) Error() string {
+	var why string
+	switch e.Limit {
+	case LimitOps:
+		why = fmt.Sprintf("it can only run %d ops", e.Max)
+	case LimitOutput:
+		why = fmt.Sprintf("it can only write %d bytes", e.Max)
+	case LimitTime:
+		why = "it ran out of time"
+	default:
+		why = "it was cancelled"
+	}
+	ran := ""
+	if e.Ops >= 0 {
+		ran = fmt.Sprintf(" after %d ops", e.Ops)
+	}
+	return fmt.Sprintf("%v: op %d, %T%v %s, stopped%s with the pointer at cell %d: %s",
+		Position(e.Opcode), e.Op, e.Opcode, e.Opcode, snippet(e.Opcode), ran, e.Pointer, why)
+}
+
+// Unwrap gives the context's error, so that errors.Is(err,
+// context.Canceled) and errors.Is(err, context.DeadlineExceeded) still work.
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// CaretIndent is the whitespace that lines a caret up under column col of
+// line, keeping any tabs so that it lines up however wide they are.
+func CaretIndent(line string, col int) string {
+	var b strings.Builder
+	for i, c := range []rune(line) {
+		if i >= col-1 {
+			break
+		}
+		if c == '\t' {
+			b.WriteRune('\t')
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	return b.String()
+}
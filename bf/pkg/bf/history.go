@@ -0,0 +1,251 @@
+package bf
+
+// history.go records what each op changes as it runs, so that a debugger can
+// run a program backwards.
+
+import "sort"
+
+// cellValue is a cell and the value it had.
+type cellValue struct {
+	cell  int
+	value int
+}
+
+// change is what running one op changed, which is enough to undo it.
+type change struct {
+	op      int
+	pointer int         // before the op
+	cells   []cellValue // the cells the op wrote, with their values before
+	read    bool        // whether the op read input, which is then input
+	input   reading
+	rerun   bool // whether this step had been run before, going forwards
+}
+
+// reading is what an Input op read: a value, or with EOFUnchanged at the end
+// of input, nothing.
+type reading struct {
+	value int
+	ok    bool
+}
+
+// snapshot is the whole tape as it was before a step.
+type snapshot struct {
+	step    int
+	op      int
+	pointer int
+	offset  int // where tape starts in the buffer, which moves if it grows
+	tape    []int
+}
+
+// history is a VM's record of the ops it's run.  It keeps the changes for the
+// last so many steps in a ring, and a snapshot of the tape every so often, so
+// that going a long way back doesn't mean undoing every op in between.  The
+// ring grows as steps are run, up to its limit, so a short program doesn't
+// pay for a long history.
+//
+// Ops run again after going backwards replay the input they read the first
+// time, and don't write their output again, so the program does exactly what
+// it did before.
+type history struct {
+	changes   []change // the change for step s is at s % limit
+	limit     int      // how many changes the ring holds once it's full
+	oldest    int      // the earliest step that can be gone back to
+	step      int      // how many ops have run
+	frontier  int      // the furthest step that's been reached
+	replay    map[int]reading
+	snapshots []snapshot // oldest first
+	interval  int        // steps between snapshots
+}
+
+// snapshotsKept is how many snapshots cover the steps in the ring.
+const snapshotsKept = 8
+
+func newHistory(limit int) *history {
+	return &history{
+		limit:    limit,
+		replay:   make(map[int]reading),
+		interval: max(limit/snapshotsKept, 1),
+	}
+}
+
+// record notes the cells op, at index i, is about to write, and where the
+// pointer is, before it runs.
+func (h *history) record(i, d int, op Opcode, buffer []int) {
+	if h.step%h.interval == 0 && (len(h.snapshots) == 0 || h.snapshots[len(h.snapshots)-1].step < h.step) {
+		tape := make([]int, len(buffer))
+		copy(tape, buffer)
+		h.snapshots = append(h.snapshots, snapshot{h.step, i, d, 0, tape})
+	}
+	if h.step-h.oldest == h.limit {
+		h.oldest++
+		for len(h.snapshots) > 0 && h.snapshots[0].step < h.oldest {
+			h.snapshots = h.snapshots[1:]
+		}
+	}
+
+	if h.step%h.limit == len(h.changes) {
+		h.changes = append(h.changes, change{})
+	}
+	c := &h.changes[h.step%h.limit]
+	c.op, c.pointer, c.cells, c.read = i, d, c.cells[:0], false
+	c.rerun = h.step < h.frontier
+	size := len(buffer)
+	save := func(offset int) {
+		cell := wrapIndex(d+offset, size)
+		c.cells = append(c.cells, cellValue{cell, buffer[cell]})
+	}
+	switch v := op.(type) {
+	case *Add:
+		save(v.offset)
+	case *Input:
+		save(v.offset)
+	case *Clear:
+		save(v.offset)
+	case *Transfer:
+		save(0)
+		save(v.distance)
+	case *MulAdd:
+		save(0)
+		for _, term := range v.terms {
+			save(term.offset)
+		}
+	}
+	h.step++
+	h.frontier = max(h.frontier, h.step)
+}
+
+// current is the change for the op that's running.
+func (h *history) current() *change {
+	return &h.changes[(h.step-1)%h.limit]
+}
+
+// undo undoes the last step, and returns the op and the pointer from before
+// it.
+func (h *history) undo(buffer []int) (int, int) {
+	h.step--
+	c := &h.changes[h.step%h.limit]
+	// Backwards, in case an op wrote the same cell twice.
+	for j := len(c.cells) - 1; j >= 0; j-- {
+		buffer[c.cells[j].cell] = c.cells[j].value
+	}
+	if c.read {
+		h.replay[h.step] = c.input
+	}
+	return c.op, c.pointer
+}
+
+// restore goes back to the nth snapshot, and returns the op and the pointer
+// from then.
+func (h *history) restore(n int, buffer []int) (int, int) {
+	snap := h.snapshots[n]
+	for step := snap.step; step < h.step; step++ {
+		if c := &h.changes[step%h.limit]; c.read {
+			h.replay[step] = c.input
+		}
+	}
+	h.step = snap.step
+	clear(buffer)
+	copy(buffer[snap.offset:], snap.tape)
+	return snap.op, snap.pointer
+}
+
+// shift moves every cell and pointer in the history n cells to the right,
+// after the tape's grown n cells to the left.
+func (h *history) shift(n int) {
+	for step := h.oldest; step < h.step; step++ {
+		c := &h.changes[step%h.limit]
+		c.pointer += n
+		for j := range c.cells {
+			c.cells[j].cell += n
+		}
+	}
+	for j := range h.snapshots {
+		h.snapshots[j].pointer += n
+		h.snapshots[j].offset += n
+	}
+}
+
+// input reads the next cell for the Input op at index op, as readCell does,
+// or, if the program's been run backwards past it, gives back what it read
+// last time.
+func (vm *VM) input(op int) (int, bool, error) {
+	h := vm.history
+	if h == nil {
+		return vm.readCell(op)
+	}
+	r, ok := h.replay[h.step-1]
+	if ok {
+		delete(h.replay, h.step-1)
+	} else {
+		var err error
+		if r.value, r.ok, err = vm.readCell(op); err != nil {
+			return 0, false, err
+		}
+	}
+	h.current().read, h.current().input = true, r
+	return r.value, r.ok, nil
+}
+
+// ReverseStep undoes the last op the VM ran, if it was created with
+// WithHistory and its history goes back that far.  It's meant to be called
+// from a step hook, and the VM carries on from the op it went back to.
+func (vm *VM) ReverseStep() bool {
+	h := vm.history
+	if h == nil || h.step == h.oldest {
+		return false
+	}
+	vm.op, vm.d = h.undo(vm.buffer)
+	return true
+}
+
+// reverseUntil runs the VM backwards to just before the last op that changed
+// one of the watched cells, or that breakAt is true for.  If the history runs
+// out first, it stops at the start of it and reports false.
+func (vm *VM) reverseUntil(watched []int, breakAt func(op int) bool) (Stop, bool) {
+	h := vm.history
+	if h == nil {
+		return Stop{}, false
+	}
+	// The value each watched cell has after the step being looked at, by
+	// index.  A cell off the tape has never been there to change.
+	after := make(map[int]int)
+	for _, cell := range watched {
+		if i := vm.origin + cell; i >= 0 && i < len(vm.buffer) {
+			after[i] = vm.buffer[i]
+		}
+	}
+
+	stop := Stop{}
+	target := h.oldest
+	for step := h.step - 1; step >= h.oldest && stop.Reason == ""; step-- {
+		c := &h.changes[step%h.limit]
+		for j := len(c.cells) - 1; j >= 0; j-- {
+			cell, old := c.cells[j].cell, c.cells[j].value
+			if value, ok := after[cell]; ok {
+				if old != value {
+					stop.Changed = append(stop.Changed, CellChange{cell - vm.origin, old, value})
+				}
+				after[cell] = old
+			}
+		}
+		switch {
+		case len(stop.Changed) > 0:
+			stop.Reason = StopWatch
+		case breakAt(c.op):
+			stop.Reason = StopBreakpoint
+		}
+		target = step
+	}
+
+	// Jump to the nearest snapshot past the target, if there's one nearer
+	// than where the VM is now, then undo the rest of the way.
+	n := sort.Search(len(h.snapshots), func(n int) bool { return h.snapshots[n].step >= target })
+	if n < len(h.snapshots) && h.snapshots[n].step < h.step {
+		vm.op, vm.d = h.restore(n, vm.buffer)
+	}
+	for h.step > target {
+		vm.op, vm.d = h.undo(vm.buffer)
+	}
+	stop.Op = vm.op
+	return stop, stop.Reason != ""
+}
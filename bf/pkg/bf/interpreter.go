@@ -0,0 +1,592 @@
+package bf
+
+// interpreter.go has the actual "VM" code interpretation functionality
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"time"
+)
+
+// cancelCheckInterval is how many backwards jumps a VM makes between checks
+// of its context.
+const cancelCheckInterval = 4096
+
+// VM runs compiled opcodes.  It holds the memory buffer and the pointer into
+// it, which are kept between calls to Run, so the same VM can be fed a
+// program a piece at a time (e.g. by the repl).
+type VM struct {
+	buffer      []int
+	bigTape     []big.Int // the tape instead, with UnboundedCells
+	d           int
+	origin      int // where the cell the program started on is in buffer
+	tapeSize    int
+	policy      TapePolicy
+	cellBits    int
+	in          inputReader
+	out         *bufio.Writer
+	inEncoding  Encoding
+	outEncoding Encoding
+	eof         EOFMode
+	trace       io.Writer
+	stepHook    func(op int) error
+	op          int // the op about to run, while the step hook is called
+	history     *history
+	countLoop   bool
+	maxOps      int
+	maxOutput   int
+	written     int // bytes of output this run, while there's a maxOutput
+	timeout     time.Duration
+	profiler    *Profiler
+	jit         bool
+	loopCount   map[int]int
+	opCount     int
+	invalid     error // what's wrong with the options, if anything
+}
+
+// Option configures a VM when it is created with NewVM.
+type Option func(*VM)
+
+// WithTapeSize sets the number of cells in the memory buffer, or with
+// TapeGrow, how many it can grow to.
+func WithTapeSize(size int) Option {
+	return func(vm *VM) {
+		vm.tapeSize = size
+	}
+}
+
+// WithTapePolicy sets what happens when a program goes off either end of the
+// tape.  The default is TapeWrap.
+func WithTapePolicy(policy TapePolicy) Option {
+	return func(vm *VM) {
+		vm.policy = policy
+	}
+}
+
+// WithCellBits makes each cell 8, 16 or 32 bits wide, wrapping around past
+// either end like an unsigned number that size, as a lot of programs expect.
+// 64, the default, leaves cells as Go ints, which wrap around at 64 bits the
+// same way, just signed.  UnboundedCells makes them integers of any size,
+// which is a lot slower, and can't be combined with the JIT, TapeGrow, a step
+// hook or history.
+func WithCellBits(bits int) Option {
+	return func(vm *VM) {
+		vm.cellBits = bits
+	}
+}
+
+// WithInput sets where Input ops read from.
+func WithInput(r io.Reader) Option {
+	return func(vm *VM) {
+		if ir, ok := r.(inputReader); ok {
+			vm.in = ir
+		} else {
+			vm.in = bufio.NewReader(r)
+		}
+	}
+}
+
+// WithInputEncoding sets how Input ops read cells.  The default is
+// EncodeBytes.
+func WithInputEncoding(encoding Encoding) Option {
+	return func(vm *VM) {
+		vm.inEncoding = encoding
+	}
+}
+
+// WithEOF sets what Input ops do at the end of input.  The default is
+// EOFUnchanged.
+func WithEOF(mode EOFMode) Option {
+	return func(vm *VM) {
+		vm.eof = mode
+	}
+}
+
+// WithOutput sets where Output ops write to.  Output is buffered
+// and flushed when Run returns or before waiting on input.
+func WithOutput(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.out = bufio.NewWriter(w)
+	}
+}
+
+// WithTrace writes a line to w describing every op as it is executed.
+func WithTrace(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.trace = w
+	}
+}
+
+// WithStepHook calls hook before each op runs, with the op's index, which is
+// enough to build a debugger on.  Output is flushed and the VM's Pointer is
+// up to date when hook is called, and if hook returns an error, Run stops and
+// returns it.
+func WithStepHook(hook func(op int) error) Option {
+	return func(vm *VM) {
+		vm.stepHook = hook
+	}
+}
+
+// WithHistory makes the VM record what each op it runs changes, up to limit
+// ops back, so that a step hook can run the program backwards with
+// ReverseStep or a Debugger.
+func WithHistory(limit int) Option {
+	return func(vm *VM) {
+		vm.history = newHistory(limit)
+	}
+}
+
+// WithOutputEncoding sets how Output ops write cells.  The default is
+// EncodeBytes.
+func WithOutputEncoding(encoding Encoding) Option {
+	return func(vm *VM) {
+		vm.outEncoding = encoding
+	}
+}
+
+// WithNumberOutput makes Output ops write cell values as numbers.  It's
+// WithOutputEncoding(EncodeNumbers).
+func WithNumberOutput() Option {
+	return WithOutputEncoding(EncodeNumbers)
+}
+
+// WithMaxOps stops each run with a *LimitError once it's run n ops, so that
+// a program that loops forever doesn't run forever.  Each step a FindEmpty
+// takes counts as an op, since it's a loop too.
+func WithMaxOps(n int) Option {
+	return func(vm *VM) {
+		vm.maxOps = n
+	}
+}
+
+// WithMaxOutput stops each run with a *LimitError before it writes more than
+// n bytes of output.
+func WithMaxOutput(n int) Option {
+	return func(vm *VM) {
+		vm.maxOutput = n
+	}
+}
+
+// WithTimeout stops each run with a *LimitError once it's been running for
+// d.  It's checked as often as cancellation is, so a program that's waiting
+// for input can run over.
+func WithTimeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.timeout = d
+	}
+}
+
+// WithProfiler profiles every run with p.
+func WithProfiler(p *Profiler) Option {
+	return func(vm *VM) {
+		vm.profiler = p
+	}
+}
+
+// WithLoopCounts makes the VM count how many times each loop is entered,
+// which can be read back with LoopCounts, and how many ops it runs in all,
+// which can be read back with OpCount.
+func WithLoopCounts() Option {
+	return func(vm *VM) {
+		vm.countLoop = true
+	}
+}
+
+// WithJIT makes the VM compile programs to native code and run that, instead
+// of interpreting them, where it can.  That's only on Linux on x86-64, and
+// only without tracing, loop counting, profiling, a step hook, history, or a
+// limit on ops or output, and with 64 bit cells on a tape that wraps,
+// otherwise it quietly falls back to interpreting.  Unbounded cells are the
+// exception: with them, every run returns an error.
+func WithJIT() Option {
+	return func(vm *VM) {
+		vm.jit = true
+	}
+}
+
+// NewVM creates a VM with a 30000 cell buffer reading from stdin and writing
+// to stdout, then applies any options.  If the options don't describe a
+// machine that can be built, such as one with no cells, every run returns an
+// error saying so.
+func NewVM(opts ...Option) *VM {
+	vm := &VM{
+		tapeSize:  30000,
+		cellBits:  64,
+		in:        bufio.NewReader(os.Stdin),
+		out:       bufio.NewWriter(os.Stdout),
+		loopCount: make(map[int]int),
+	}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	config := Config{TapeSize: vm.tapeSize, CellBits: vm.cellBits, EOF: vm.eof}
+	if vm.invalid = config.validate(); vm.invalid != nil {
+		return vm
+	}
+	if vm.cellBits == UnboundedCells {
+		if vm.invalid = vm.unboundedInvalid(); vm.invalid == nil {
+			vm.bigTape = make([]big.Int, vm.tapeSize)
+		}
+		return vm
+	}
+	if vm.policy == TapeGrow {
+		vm.buffer = make([]int, min(vm.tapeSize, initialGrowth))
+	} else {
+		vm.buffer = make([]int, vm.tapeSize)
+	}
+	return vm
+}
+
+// Tape returns the VM's memory buffer.  With TapeGrow, it can be replaced by
+// a bigger one whenever the program runs.  With UnboundedCells, it's nil, and
+// the cells are read with BigCell.
+func (vm *VM) Tape() []int {
+	return vm.buffer
+}
+
+// TapeLen returns how many cells the tape has, which with TapeGrow is how many
+// it's grown to so far.
+func (vm *VM) TapeLen() int {
+	if vm.cellBits == UnboundedCells {
+		return len(vm.bigTape)
+	}
+	return len(vm.buffer)
+}
+
+// Pointer returns the index of the current buffer slot.
+func (vm *VM) Pointer() int {
+	return vm.d
+}
+
+// Origin returns the index in the buffer of the cell the program started on.
+// It's 0 unless the tape has grown to the left, which moves every cell along.
+func (vm *VM) Origin() int {
+	return vm.origin
+}
+
+// Cell returns the value of cell n, counting from the one the program started
+// on, or 0 if the tape doesn't reach that far.  With UnboundedCells, it's the
+// low 64 bits of the cell.
+func (vm *VM) Cell(n int) int {
+	if vm.cellBits == UnboundedCells {
+		return int(vm.BigCell(n).Int64())
+	}
+	if i := vm.origin + n; i >= 0 && i < len(vm.buffer) {
+		return vm.buffer[i]
+	}
+	return 0
+}
+
+// Op returns the index of the op about to run, while the step hook is called.
+func (vm *VM) Op() int {
+	return vm.op
+}
+
+// LoopCounts maps the index of each RJump to the number of times it was hit,
+// if the VM was created with WithLoopCounts.
+func (vm *VM) LoopCounts() map[int]int {
+	return vm.loopCount
+}
+
+// OpCount is the number of ops the VM has run, if it was created with
+// WithLoopCounts.
+func (vm *VM) OpCount() int {
+	return vm.opCount
+}
+
+// Reset zeroes the buffer and moves the pointer back to the cell it started
+// on.
+func (vm *VM) Reset() {
+	clear(vm.buffer)
+	for i := range vm.bigTape {
+		vm.bigTape[i].SetInt64(0)
+	}
+	clear(vm.loopCount)
+	vm.opCount = 0
+	vm.d = vm.origin
+	if vm.history != nil {
+		vm.history = newHistory(vm.history.limit)
+	}
+}
+
+// EvalBfOps evaluates compiled, optimized BF opcodes on a fresh VM using
+// stdin and stdout.  It runs until the program finishes, however long that
+// takes, so untrusted programs should go through RunContext on a VM with
+// limits instead.
+func EvalBfOps(ops []Opcode) error {
+	return NewVM().Run(ops)
+}
+
+// Run evaluates compiled, optimized BF opcodes, leaving the buffer and pointer
+// as the program left them.
+func (vm *VM) Run(ops []Opcode) error {
+	return vm.RunContext(context.Background(), ops)
+}
+
+// RunContext is Run, but stops early with a *LimitError, wrapping the
+// context's error, if ctx is cancelled or its deadline passes while the
+// program is running.
+func (vm *VM) RunContext(ctx context.Context, ops []Opcode) (err error) {
+	if vm.invalid != nil {
+		return vm.invalid
+	}
+	if vm.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vm.timeout)
+		defer cancel()
+	}
+	if vm.cellBits == UnboundedCells {
+		return vm.runUnbounded(ctx, ops)
+	}
+	if vm.jit && vm.jitSupported() {
+		return vm.runJIT(ctx, ops)
+	}
+	i := 0
+	d := vm.d
+	buffer := vm.buffer
+	size := len(buffer)
+	mask := vm.cellMask()
+	done := ctx.Done()
+	backJumps := 0
+	// The number of ops run can never reach a budget of -1.
+	ran, budget := 0, -1
+	if vm.maxOps > 0 {
+		budget = vm.maxOps
+	}
+	vm.written = 0
+	prof := vm.profiler
+	if prof != nil {
+		defer prof.begin(ops)()
+	}
+	defer func() {
+		vm.d = d
+		if flushErr := vm.out.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
+
+	for i >= 0 && i < len(ops) {
+		if ran == budget {
+			return vm.limitError(LimitOps, ops, i, d, ran, nil)
+		}
+		ran++
+		if prof != nil {
+			prof.counts[i]++
+			if prof.due.Load() {
+				prof.sample(i)
+			}
+		}
+		if vm.trace != nil {
+			fmt.Fprintf(vm.trace, "%05d: %T%v %s, %d: [%d]\n", i, ops[i], ops[i], snippet(ops[i]), d, buffer[d])
+		}
+		if vm.countLoop {
+			vm.opCount++
+		}
+		if vm.stepHook != nil {
+			vm.d, vm.op = d, i
+			if err := vm.out.Flush(); err != nil {
+				return err
+			}
+			if err := vm.stepHook(i); err != nil {
+				return err
+			}
+			// The hook may have run the program backwards.
+			i, d = vm.op, vm.d
+		}
+		if vm.policy != TapeWrap {
+			if lo, hi := reach(ops[i], buffer[d]); d+lo < 0 || d+hi >= size {
+				if d, err = vm.fitTape(i, ops[i], d, lo, hi); err != nil {
+					return err
+				}
+				buffer, size = vm.buffer, len(vm.buffer)
+			}
+		}
+		if vm.history != nil {
+			vm.history.record(i, d, ops[i], buffer)
+		}
+		switch v := ops[i].(type) {
+		case *Move:
+			d = wrapIndex(d+v.amount, size)
+		case *Add:
+			c := wrapIndex(d+v.offset, size)
+			buffer[c] = (buffer[c] + v.amount) & mask
+		case *Output:
+			if vm.history == nil || !vm.history.current().rerun {
+				c := buffer[wrapIndex(d+v.offset, size)]
+				if !vm.fitsOutput(c) {
+					return vm.limitError(LimitOutput, ops, i, d, ran-1, nil)
+				}
+				vm.writeCell(c)
+			}
+		case *Input:
+			c, ok, err := vm.input(i)
+			if err != nil {
+				return err
+			}
+			if ok {
+				buffer[wrapIndex(d+v.offset, size)] = c & mask
+			}
+		case *RJump:
+			if vm.countLoop {
+				vm.loopCount[i] += 1
+			}
+			if buffer[d] == 0 {
+				i = v.target
+			}
+		case *LJump:
+			if buffer[d] != 0 {
+				// Only loops can run forever, so this and scans are the only
+				// places that need to check for cancellation, and not every
+				// time.
+				backJumps++
+				if done != nil && backJumps%cancelCheckInterval == 0 && isDone(done) {
+					return vm.limitError(contextLimit(ctx.Err()), ops, i, d, ran-1, ctx.Err())
+				}
+				i = v.target
+			}
+		case *Clear:
+			buffer[wrapIndex(d+v.offset, size)] = 0
+		case *Transfer:
+			newInd := wrapIndex(d+v.distance, size)
+			buffer[newInd] = (buffer[newInd] + buffer[d]) & mask
+			buffer[d] = 0
+		case *MulAdd:
+			for _, term := range v.terms {
+				c := wrapIndex(d+term.offset, size)
+				buffer[c] = (buffer[c] + buffer[d]*term.factor) & mask
+			}
+			buffer[d] = 0
+		case *FindEmpty:
+			// A scan is a loop too, and on a tape with no empty cells it
+			// never ends, so each step counts as an op and as a jump back.
+			for buffer[d] != 0 {
+				if ran == budget {
+					return vm.limitError(LimitOps, ops, i, d, ran, nil)
+				}
+				ran++
+				backJumps++
+				if done != nil && backJumps%cancelCheckInterval == 0 && isDone(done) {
+					return vm.limitError(contextLimit(ctx.Err()), ops, i, d, ran-1, ctx.Err())
+				}
+				d += v.step
+				if d < 0 || d >= size {
+					if d, err = vm.offTape(i, ops[i], d); err != nil {
+						return err
+					}
+					buffer, size = vm.buffer, len(vm.buffer)
+				}
+			}
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", ops[i], i)
+		}
+		i++
+	}
+	return nil
+}
+
+// isDone reports whether done is closed, without waiting for it.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// cellMask is what the result of any arithmetic on a cell is ANDed with to
+// wrap it to the cell width.  64 bit cells are left alone, since Go ints wrap
+// at that width anyway.
+func (vm *VM) cellMask() int {
+	if vm.cellBits >= 64 {
+		return -1
+	}
+	return 1<<vm.cellBits - 1
+}
+
+// wrapIndex wraps a buffer index that's gone off either end of a buffer of
+// size cells back around.  Offsets are almost always small, so it only falls
+// back to dividing when the index isn't already in range.
+func wrapIndex(i, size int) int {
+	if i >= 0 && i < size {
+		return i
+	}
+	return ((i % size) + size) % size
+}
+
+// RunSource evaluates a string of bf code with no optimizations as-is.  It's
+// the original, much slower, interpreter and is kept around for reference, so
+// it doesn't do unbounded cells.
+func (vm *VM) RunSource(source string) (err error) {
+	if vm.invalid != nil {
+		return vm.invalid
+	}
+	if vm.cellBits == UnboundedCells {
+		return errors.New("RunSource only runs cells of a fixed width, not unbounded ones")
+	}
+	i := 0
+	d := vm.d
+	buffer := vm.buffer
+	size := len(buffer)
+	mask := vm.cellMask()
+	loopCounter := 0
+	defer func() {
+		vm.d = d
+		if flushErr := vm.out.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
+
+	for i >= 0 && i < len(source) {
+		if vm.trace != nil {
+			fmt.Fprintf(vm.trace, "%d: %c, %d: [%d]\n", i, source[i], d, buffer[d])
+		}
+		switch source[i] {
+		case '>':
+			d = (d + 1) % size
+		case '<':
+			d = (d - 1 + size) % size
+		case '+':
+			buffer[d] = (buffer[d] + 1) & mask
+		case '-':
+			buffer[d] = (buffer[d] - 1) & mask
+		case '.':
+			vm.writeCell(buffer[d])
+		case ',':
+			c, ok, err := vm.readCell(i)
+			if err != nil {
+				return err
+			}
+			if ok {
+				buffer[d] = c & mask
+			}
+		case '[':
+			if buffer[d] == 0 {
+				for i++; source[i] != ']' || loopCounter != 0; i++ {
+					if source[i] == '[' {
+						loopCounter++
+					} else if source[i] == ']' {
+						loopCounter--
+					}
+				}
+			}
+		case ']':
+			if buffer[d] != 0 {
+				for i--; source[i] != '[' || loopCounter != 0; i-- {
+					if source[i] == '[' {
+						loopCounter--
+					} else if source[i] == ']' {
+						loopCounter++
+					}
+				}
+			}
+		}
+		i++
+	}
+	return nil
+}
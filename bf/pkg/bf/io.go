@@ -0,0 +1,144 @@
+package bf
+
+// io.go turns cells into output and input into cells.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Encoding is how cells are read from input and written to output.
+type Encoding int
+
+const (
+	// EncodeBytes reads and writes a byte per cell, keeping the low 8 bits
+	// of a cell when writing it.  It's what compiled programs do, and it
+	// can read and write anything, not just text.
+	EncodeBytes Encoding = iota
+	// EncodeUTF8 reads and writes a character per cell, encoded as UTF-8,
+	// for cells wider than a byte.
+	EncodeUTF8
+	// EncodeNumbers reads whitespace separated decimal numbers, and writes
+	// each cell as a number followed by a space.
+	EncodeNumbers
+)
+
+// encodings are the encodings' names, for ParseEncoding and String.
+var encodings = []string{"bytes", "utf8", "numbers"}
+
+// ParseEncoding finds the encoding called name: "bytes", "utf8" or
+// "numbers".
+func ParseEncoding(name string) (Encoding, error) {
+	for i, encoding := range encodings {
+		if encoding == name {
+			return Encoding(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encoding %q: must be bytes, utf8 or numbers", name)
+}
+
+func (e Encoding) String() string {
+	if e < 0 || int(e) >= len(encodings) {
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+	return encodings[e]
+}
+
+// EOFMode is what an Input op does at the end of input.
+type EOFMode int
+
+const (
+	// EOFUnchanged leaves the cell as it was.  It's the default, so that
+	// programs that read until they run out of input can finish.
+	EOFUnchanged EOFMode = iota
+	// EOFZero sets the cell to 0.
+	EOFZero
+	// EOFMinusOne sets the cell to -1, which wraps around to the biggest
+	// value a cell can hold if it's narrower than 64 bits.
+	EOFMinusOne
+	// EOFError stops the program with an error.
+	EOFError
+)
+
+// eofModes are the modes' names, for ParseEOFMode and String.
+var eofModes = []string{"unchanged", "0", "-1", "error"}
+
+// ParseEOFMode finds the EOF mode called name: "unchanged", "0", "-1" or
+// "error".
+func ParseEOFMode(name string) (EOFMode, error) {
+	for i, mode := range eofModes {
+		if mode == name {
+			return EOFMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown EOF mode %q: must be unchanged, 0, -1 or error", name)
+}
+
+func (m EOFMode) String() string {
+	if m < 0 || int(m) >= len(eofModes) {
+		return fmt.Sprintf("EOFMode(%d)", int(m))
+	}
+	return eofModes[m]
+}
+
+// inputReader is what the VM reads input with: bytes for EncodeBytes, runes
+// for EncodeUTF8, and runes it can put back for EncodeNumbers.
+type inputReader interface {
+	io.Reader
+	io.ByteReader
+	io.RuneScanner
+}
+
+// writeCell writes the value of a cell to the output.
+func (vm *VM) writeCell(value int) {
+	switch vm.outEncoding {
+	case EncodeUTF8:
+		vm.out.WriteRune(rune(value))
+	case EncodeNumbers:
+		vm.out.WriteString(strconv.Itoa(value))
+		vm.out.WriteByte(' ')
+	default:
+		vm.out.WriteByte(byte(value))
+	}
+}
+
+// readCell reads the next cell of input for the Input op at index op, after
+// flushing any output so prompts show up first.  At the end of input, it
+// reports false if the cell should be left alone, and otherwise what the EOF
+// mode says to set it to.
+func (vm *VM) readCell(op int) (int, bool, error) {
+	if err := vm.out.Flush(); err != nil {
+		return 0, false, err
+	}
+	var c int
+	var err error
+	switch vm.inEncoding {
+	case EncodeUTF8:
+		var r rune
+		r, _, err = vm.in.ReadRune()
+		c = int(r)
+	case EncodeNumbers:
+		_, err = fmt.Fscan(vm.in, &c)
+	default:
+		var b byte
+		b, err = vm.in.ReadByte()
+		c = int(b)
+	}
+
+	if errors.Is(err, io.EOF) {
+		switch vm.eof {
+		case EOFUnchanged:
+			return 0, false, nil
+		case EOFZero:
+			return 0, true, nil
+		case EOFMinusOne:
+			return -1, true, nil
+		}
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("reading input at op %d: %w", op, err)
+	}
+	return c, true, nil
+}
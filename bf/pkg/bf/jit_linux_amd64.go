@@ -0,0 +1,212 @@
+package bf
+
+// jit_linux_amd64.go compiles opcodes to machine code in memory and runs it
+// in-process.  The generated code returns to Go whenever it needs I/O done
+// (and every so often so that the context can be checked), then gets called
+// again to carry on where it left off.
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// jitCall calls the machine code at code, passing it state.  It's in
+// jit_linux_amd64.s.
+func jitCall(code, state uintptr) uint64
+
+// Reasons for the generated code to return to Go.
+const (
+	jitDone = iota
+	jitFlush
+	jitInput
+	jitYield
+)
+
+// jitOutSize is how many cells of output are buffered before returning to
+// Go to write them out.
+const jitOutSize = 4096
+
+// jitYieldInterval is how many backwards jumps the generated code makes
+// before returning to Go so the context can be checked.
+const jitYieldInterval = 1 << 20
+
+// jitState is shared between Go and the generated code.  The offsets of its
+// fields are baked into the code, so don't reorder them.
+type jitState struct {
+	tape    uintptr // 0
+	pointer uint64  // 8
+	out     uintptr // 16
+	outLen  uint64  // 24
+	resume  uintptr // 32: where to carry on from on the next call
+	op      uint64  // 40: the op that asked for input or yielded
+	budget  uint64  // 48: backwards jumps left before yielding
+}
+
+// stateReg holds the address of the jitState while the generated code runs.
+const stateReg = r15
+
+func stateField(offset int32) x86Mem {
+	return x86Mem{base: stateReg, index: noIndex, disp: offset}
+}
+
+// jitRuntime leaves the generated code to do I/O in Go.  Output is buffered
+// as whole cells, so Go can write them exactly like the VM does.
+type jitRuntime struct {
+	exit x86Label
+}
+
+// suspend returns to Go with reason, to carry on from the next instruction.
+func (j *jitRuntime) suspend(a *x86Asm, reason int64) {
+	next := a.newLabel()
+	a.leaLabel(rax, next)
+	a.movMemReg(8, stateField(32), rax)
+	a.movRegImm(rax, reason)
+	a.jmp(j.exit)
+	a.place(next)
+}
+
+func (j *jitRuntime) output(a *x86Asm) {
+	next := a.newLabel()
+	a.movRegMem(rax, x86Mem{base: rsi, index: noIndex})
+	a.movMemReg(8, x86Mem{base: outBufReg, index: outLenReg, scale: 8}, rax)
+	a.incReg(outLenReg)
+	a.cmpRegImm(outLenReg, jitOutSize)
+	a.jcc(condB, next)
+	j.suspend(a, jitFlush)
+	a.place(next)
+}
+
+func (j *jitRuntime) input(a *x86Asm, op int) {
+	a.movMemImm(8, stateField(40), int64(op))
+	j.suspend(a, jitInput)
+}
+
+func (j *jitRuntime) loopBack(a *x86Asm, op int, open x86Label) {
+	done := a.newLabel()
+	a.jcc(condE, done)
+	a.subMemImm(stateField(48), 1)
+	a.jcc(condNE, open)
+	a.movMemImm(8, stateField(40), int64(op))
+	j.suspend(a, jitYield)
+	a.jmp(open)
+	a.place(done)
+}
+
+// jitSupported reports whether this VM's settings can be run by the JIT.
+// Tracing, loop counting, profiling, step hooks, history and limits on ops or
+// output need the interpreter to see every op, and the generated code only
+// knows 64 bit cells and wrapping.
+func (vm *VM) jitSupported() bool {
+	return vm.trace == nil && !vm.countLoop && vm.profiler == nil && vm.stepHook == nil && vm.history == nil &&
+		vm.maxOps <= 0 && vm.maxOutput <= 0 && vm.cellBits == 64 && vm.policy == TapeWrap
+}
+
+// compileJIT lowers ops to machine code that runs on a tape of size cells.
+// It returns the code and the offset of the first op, to start from.
+func compileJIT(ops []Opcode, size int) ([]byte, int, error) {
+	a := &x86Asm{}
+	rt := &jitRuntime{exit: a.newLabel()}
+	saved := []x86Reg{rbx, rbp, r12, r13, r14, r15}
+
+	for _, r := range saved {
+		a.push(r)
+	}
+	a.movRegReg(stateReg, rdi)
+	a.movRegMem(tapeReg, stateField(0))
+	a.movRegMem(pointerReg, stateField(8))
+	a.movRegMem(outBufReg, stateField(16))
+	a.movRegMem(outLenReg, stateField(24))
+	a.jmpMem(stateField(32))
+
+	start := len(a.code)
+	config := Config{TapeSize: size, CellBits: 64}
+	if err := lowerOps(a, ops, config, rt); err != nil {
+		return nil, 0, err
+	}
+	a.movRegImm(rax, jitDone)
+
+	a.place(rt.exit)
+	a.movMemReg(8, stateField(8), pointerReg)
+	a.movMemReg(8, stateField(24), outLenReg)
+	for i := len(saved) - 1; i >= 0; i-- {
+		a.pop(saved[i])
+	}
+	a.ret()
+
+	if err := a.link(); err != nil {
+		return nil, 0, err
+	}
+	return a.code, start, nil
+}
+
+// runJIT runs ops as native code.
+func (vm *VM) runJIT(ctx context.Context, ops []Opcode) (err error) {
+	code, start, err := compileJIT(ops, len(vm.buffer))
+	if err != nil {
+		return err
+	}
+	mem, err := syscall.Mmap(-1, 0, len(code), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return fmt.Errorf("jit: %w", err)
+	}
+	defer syscall.Munmap(mem)
+	copy(mem, code)
+	if err := syscall.Mprotect(mem, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		return fmt.Errorf("jit: %w", err)
+	}
+
+	// The generated code only has the addresses of the tape, the output
+	// buffer and the state, which Go can't see as pointers, so they're
+	// pinned to the heap for the whole run.  Otherwise anything on the
+	// goroutine's stack could move whenever the code returns to Go.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	out := make([]int, jitOutSize)
+	pinner.Pin(&out[0])
+	pinner.Pin(&vm.buffer[0])
+	base := uintptr(unsafe.Pointer(&mem[0]))
+	state := &jitState{
+		tape:    uintptr(unsafe.Pointer(&vm.buffer[0])),
+		pointer: uint64(vm.d),
+		out:     uintptr(unsafe.Pointer(&out[0])),
+		resume:  base + uintptr(start),
+	}
+	pinner.Pin(state)
+	defer func() {
+		vm.d = int(state.pointer)
+		if flushErr := vm.out.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
+
+	for {
+		state.budget = jitYieldInterval
+		reason := jitCall(base, uintptr(unsafe.Pointer(state)))
+
+		for _, c := range out[:state.outLen] {
+			vm.writeCell(c)
+		}
+		state.outLen = 0
+
+		switch reason {
+		case jitDone:
+			return nil
+		case jitInput:
+			c, ok, err := vm.readCell(int(state.op))
+			if err != nil {
+				return err
+			}
+			if ok {
+				in, _ := ops[state.op].(*Input)
+				vm.buffer[wrapIndex(int(state.pointer)+in.offset, len(vm.buffer))] = c
+			}
+		case jitYield:
+			if err := ctx.Err(); err != nil {
+				return vm.limitError(contextLimit(err), ops, int(state.op), int(state.pointer), -1, err)
+			}
+		}
+	}
+}
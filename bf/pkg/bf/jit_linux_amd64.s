@@ -0,0 +1,18 @@
+#include "textflag.h"
+
+// func jitCall(code, state uintptr) uint64
+//
+// The generated code saves and restores every register it uses by pushing
+// them, so it needs 56 bytes of stack: six callee-saved registers and the
+// return address of the CALL.  This is NOSPLIT, so it gets no more stack
+// than its frame, and the frame is sized to hold those pushes: SP is moved
+// up to the top of the frame for the CALL, so everything pushed lands inside
+// it rather than past the end of the goroutine's stack.
+TEXT ·jitCall(SB), NOSPLIT, $64-24
+	MOVQ code+0(FP), AX
+	MOVQ state+8(FP), DI
+	ADJSP $-64
+	CALL AX
+	ADJSP $64
+	MOVQ AX, ret+16(FP)
+	RET
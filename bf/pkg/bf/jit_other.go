@@ -0,0 +1,16 @@
+//go:build !(linux && amd64)
+
+package bf
+
+// jit_other.go stands in for the JIT on platforms it doesn't support, so
+// that WithJIT falls back to the interpreter there.
+
+import "context"
+
+func (vm *VM) jitSupported() bool {
+	return false
+}
+
+func (vm *VM) runJIT(ctx context.Context, ops []Opcode) error {
+	panic("bf: the JIT isn't supported on this platform")
+}
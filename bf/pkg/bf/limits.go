@@ -0,0 +1,85 @@
+package bf
+
+// limits.go stops programs that run for too long or write too much, so that
+// untrusted ones can be run safely.
+
+import (
+	"context"
+	"errors"
+	"unicode/utf8"
+)
+
+// Limit says what stopped a program before it finished.
+type Limit string
+
+const (
+	LimitOps       Limit = "ops"       // it ran as many ops as WithMaxOps allows
+	LimitOutput    Limit = "output"    // it wrote as much as WithMaxOutput allows
+	LimitTime      Limit = "time"      // its WithTimeout, or its context's deadline, passed
+	LimitCancelled Limit = "cancelled" // its context was cancelled
+)
+
+// contextLimit is the limit that a context's error means was hit.
+func contextLimit(err error) Limit {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return LimitTime
+	}
+	return LimitCancelled
+}
+
+// limitError describes the program being stopped before op i, with the
+// pointer at index d, after running ran ops.
+func (vm *VM) limitError(limit Limit, ops []Opcode, i, d, ran int, err error) *LimitError {
+	e := &LimitError{Limit: limit, Op: i, Ops: ran, Pointer: d - vm.origin, Err: err}
+	if i >= 0 && i < len(ops) {
+		e.Opcode = ops[i]
+	}
+	switch limit {
+	case LimitOps:
+		e.Max = vm.maxOps
+	case LimitOutput:
+		e.Max = vm.maxOutput
+	}
+	return e
+}
+
+// cellSize is how many bytes writeCell writes for value.
+func (vm *VM) cellSize(value int) int {
+	switch vm.outEncoding {
+	case EncodeUTF8:
+		if n := utf8.RuneLen(rune(value)); n > 0 {
+			return n
+		}
+		return utf8.RuneLen(utf8.RuneError)
+	case EncodeNumbers:
+		n := 2 // a digit and the space
+		if value < 0 {
+			n++
+		}
+		for value /= 10; value != 0; value /= 10 {
+			n++
+		}
+		return n
+	default:
+		return 1
+	}
+}
+
+// fitsOutput reports whether value can be written without going over the
+// output limit, and counts it as written if so.
+func (vm *VM) fitsOutput(value int) bool {
+	return vm.fitsBytes(vm.cellSize(value))
+}
+
+// fitsBytes reports whether n more bytes can be written without going over
+// the output limit, and counts them as written if so.
+func (vm *VM) fitsBytes(n int) bool {
+	if vm.maxOutput <= 0 {
+		return true
+	}
+	if vm.written+n > vm.maxOutput {
+		return false
+	}
+	vm.written += n
+	return true
+}
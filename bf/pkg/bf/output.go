@@ -0,0 +1,122 @@
+package bf
+
+// output.go contains helpers for outputting debugging info
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// PrintOps prints opcodes in a basic way.  Sort of a dissassembler for bf
+// syntax.  Each op is followed by where it starts in the source and the
+// source it came from.
+func PrintOps(w io.Writer, ops []Opcode) {
+	for i, op := range ops {
+		fmt.Fprintf(w, "%05d:\t%T%v\t%v\t%s\n", i, op, op, Position(op), snippet(op))
+	}
+}
+
+// maxSnippet is how many bytes of source snippet shows before cutting it
+// short.
+const maxSnippet = 32
+
+// snippet is the source op came from, quoted so that newlines don't break up
+// the line it's printed on, and cut short if it's long.
+func snippet(op Opcode) string {
+	source := SnippetOf(op)
+	if len(source) > maxSnippet {
+		return strconv.Quote(source[:maxSnippet]) + "..."
+	}
+	return strconv.Quote(source)
+}
+
+// The String methods print ops' fields, leaving out where they came from,
+// which PrintOps shows separately.
+
+func (l *Loop) String() string      { return fmt.Sprintf("{%d ops}", len(l.body)) }
+func (r *RJump) String() string     { return fmt.Sprintf("{%d}", r.target) }
+func (l *LJump) String() string     { return fmt.Sprintf("{%d}", l.target) }
+func (a *Add) String() string       { return fmt.Sprintf("{%d %d}", a.amount, a.offset) }
+func (m *Move) String() string      { return fmt.Sprintf("{%d}", m.amount) }
+func (t *Transfer) String() string  { return fmt.Sprintf("{%d}", t.distance) }
+func (m *MulAdd) String() string    { return fmt.Sprintf("{%v}", m.terms) }
+func (f *FindEmpty) String() string { return fmt.Sprintf("{%d}", f.step) }
+func (in *Input) String() string    { return fmt.Sprintf("{%d}", in.offset) }
+func (o *Output) String() string    { return fmt.Sprintf("{%d}", o.offset) }
+func (c *Clear) String() string     { return fmt.Sprintf("{%d}", c.offset) }
+
+// PrintOpsCompact converts opcodes back into a processed almost-bf syntax for
+// quick checks.  Ops on a slot other than the current one are followed by
+// @offset.
+func PrintOpsCompact(w io.Writer, ops []Opcode) {
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *Add:
+			fmt.Fprintf(w, "%d%c", v.amount, '+')
+			printOffset(w, v.offset)
+		case *Move:
+			fmt.Fprintf(w, "%d%c", v.amount, '>')
+		case *Input:
+			fmt.Fprint(w, ",")
+			printOffset(w, v.offset)
+		case *Output:
+			fmt.Fprint(w, ".")
+			printOffset(w, v.offset)
+		case *RJump:
+			fmt.Fprint(w, "[")
+		case *LJump:
+			fmt.Fprint(w, "]")
+		case *Clear:
+			fmt.Fprint(w, "x")
+			printOffset(w, v.offset)
+		case *Transfer:
+			fmt.Fprintf(w, "%dT", v.distance)
+		case *MulAdd:
+			fmt.Fprint(w, "(")
+			for i, term := range v.terms {
+				if i > 0 {
+					fmt.Fprint(w, " ")
+				}
+				fmt.Fprintf(w, "%d*%d", term.offset, term.factor)
+			}
+			fmt.Fprint(w, ")M")
+		case *FindEmpty:
+			fmt.Fprintf(w, "%dF", v.step)
+		default:
+			panic(fmt.Sprintf("Unrecognized op %T\n", op))
+		}
+	}
+}
+
+// printOffset prints an op's offset for PrintOpsCompact, if it has one.
+func printOffset(w io.Writer, offset int) {
+	if offset != 0 {
+		fmt.Fprintf(w, "@%d", offset)
+	}
+}
+
+// KV is used to sort loop count maps
+type KV struct {
+	key   int
+	value int
+}
+
+// PrintLoops prints the encountered loops in order of increasing number of
+// iterations run.
+func PrintLoops(w io.Writer, ops []Opcode, loops map[int]int) {
+	items := make([]KV, 0, len(loops))
+	for i, count := range loops {
+		items = append(items, KV{i, count})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].value < items[j].value
+	})
+	for _, pair := range items {
+		start, _ := ops[pair.key].(*RJump)
+		fmt.Fprintf(w, "%d: ", pair.value)
+		PrintOpsCompact(w, ops[pair.key:start.target+1])
+		fmt.Fprint(w, "\n")
+	}
+}
@@ -0,0 +1,148 @@
+package bf
+
+// passes.go contains the optimization pipeline: the list of passes, and the
+// options for choosing which of them run.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxOptLevel is the highest optimization level, and the default.  It runs
+// every pass.
+const MaxOptLevel = 3
+
+// pass is one step of optimization.  It takes a tree of ops (see Loop) and
+// returns a new one.
+type pass struct {
+	name  string
+	level int // the lowest optimization level that runs the pass
+	run   func(tree []Opcode) []Opcode
+}
+
+// passes run in this order.  The loop idioms need runs combined first, and
+// offsets come last since the loop idioms look for Moves.
+var passes = []pass{
+	{"combine", 1, func(tree []Opcode) []Opcode { return mapBlocks(tree, combineRuns) }},
+	{"clear", 2, func(tree []Opcode) []Opcode { return rewriteLoops(tree, optimizeClear) }},
+	{"scan", 2, func(tree []Opcode) []Opcode { return rewriteLoops(tree, optimizeFindEmpty) }},
+	{"muladd", 2, func(tree []Opcode) []Opcode { return rewriteLoops(tree, optimizeMulAdd) }},
+	{"offsets", 3, func(tree []Opcode) []Opcode { return mapBlocks(tree, deferMoves) }},
+}
+
+// PassNames lists the optimization passes in the order they run.
+func PassNames() []string {
+	names := make([]string, len(passes))
+	for i, p := range passes {
+		names[i] = p.name
+	}
+	return names
+}
+
+// compileConfig is what the CompileOptions set.
+type compileConfig struct {
+	filename   string
+	level      int
+	enabled    map[string]bool // passes turned on or off regardless of level
+	printAfter map[string]io.Writer
+}
+
+// CompileOption configures how Compile optimizes a program.
+type CompileOption func(*compileConfig)
+
+// WithFilename names the file the source came from, for error messages.
+func WithFilename(name string) CompileOption {
+	return func(c *compileConfig) {
+		c.filename = name
+	}
+}
+
+// WithOptLevel runs the passes for an optimization level from 0 (none at all)
+// to MaxOptLevel.
+func WithOptLevel(level int) CompileOption {
+	return func(c *compileConfig) {
+		c.level = level
+	}
+}
+
+// WithPass runs the named pass whatever the optimization level.
+func WithPass(name string) CompileOption {
+	return func(c *compileConfig) {
+		c.enabled[name] = true
+	}
+}
+
+// WithoutPass skips the named pass whatever the optimization level.
+func WithoutPass(name string) CompileOption {
+	return func(c *compileConfig) {
+		c.enabled[name] = false
+	}
+}
+
+// WithPrintAfter writes the ops to w with PrintOps after the named pass runs.
+func WithPrintAfter(name string, w io.Writer) CompileOption {
+	return func(c *compileConfig) {
+		c.printAfter[name] = w
+	}
+}
+
+func newCompileConfig(opts []CompileOption) *compileConfig {
+	c := &compileConfig{
+		level:      MaxOptLevel,
+		enabled:    make(map[string]bool),
+		printAfter: make(map[string]io.Writer),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// validate checks that the level is in range and that every pass named by
+// the options exists.
+func (c *compileConfig) validate() error {
+	if c.level < 0 || c.level > MaxOptLevel {
+		return fmt.Errorf("optimization level must be 0 to %d, got %d", MaxOptLevel, c.level)
+	}
+	known := make(map[string]bool)
+	for _, p := range passes {
+		known[p.name] = true
+	}
+	check := func(name string) error {
+		if !known[name] {
+			return fmt.Errorf("unknown pass %q (passes are %s)", name, strings.Join(PassNames(), ", "))
+		}
+		return nil
+	}
+	for name := range c.enabled {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	for name := range c.printAfter {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optimize runs the chosen passes over a tree of ops.
+func (c *compileConfig) optimize(tree []Opcode) []Opcode {
+	for _, p := range passes {
+		enabled, ok := c.enabled[p.name]
+		if !ok {
+			enabled = p.level <= c.level
+		}
+		if !enabled {
+			continue
+		}
+
+		tree = p.run(tree)
+		if w, ok := c.printAfter[p.name]; ok {
+			PrintOps(w, linearize(tree))
+		}
+	}
+	return tree
+}
@@ -0,0 +1,161 @@
+package bf
+
+// pprof.go writes profiles in pprof's format: a gzipped protocol buffer, as
+// described by profile.proto in github.com/google/pprof.  Only the handful
+// of fields a Profiler needs are written, by hand, to save depending on a
+// protocol buffer package.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// The field numbers used from profile.proto.
+const (
+	// Profile
+	pprofSampleType = 1
+	pprofSample     = 2
+	pprofLocation   = 4
+	pprofFunction   = 5
+	pprofStrings    = 6
+	pprofTime       = 9
+	pprofDuration   = 10
+	pprofPeriodType = 11
+	pprofPeriod     = 12
+	pprofComment    = 13
+
+	// ValueType
+	pprofType = 1
+	pprofUnit = 2
+
+	// Sample
+	pprofLocationID = 1
+	pprofValue      = 2
+
+	// Location
+	pprofID   = 1
+	pprofLine = 4
+
+	// Line
+	pprofFunctionID = 1
+	pprofLineNumber = 2
+
+	// Function (and pprofID)
+	pprofName      = 2
+	pprofFilename  = 4
+	pprofStartLine = 5
+)
+
+// protoBuf builds up one protocol buffer message.
+type protoBuf struct {
+	bytes.Buffer
+}
+
+func (b *protoBuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+// tag starts field num, with wire type 0 for a varint or 2 for bytes.
+func (b *protoBuf) tag(num, wire int) {
+	b.varint(uint64(num<<3 | wire))
+}
+
+// int writes a varint field, unless it's zero, which is the default anyway.
+func (b *protoBuf) int(num int, x int64) {
+	if x != 0 {
+		b.tag(num, 0)
+		b.varint(uint64(x))
+	}
+}
+
+func (b *protoBuf) bytes(num int, p []byte) {
+	b.tag(num, 2)
+	b.varint(uint64(len(p)))
+	b.Write(p)
+}
+
+func (b *protoBuf) message(num int, m *protoBuf) {
+	b.bytes(num, m.Bytes())
+}
+
+// packed writes a repeated varint field in packed form.
+func (b *protoBuf) packed(num int, xs []int64) {
+	var p protoBuf
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	b.message(num, &p)
+}
+
+// pprofWriter collects a profile, keeping the string table as it goes.
+type pprofWriter struct {
+	profile protoBuf
+	strings map[string]int64
+	table   []string
+}
+
+func newPprofWriter() *pprofWriter {
+	return &pprofWriter{strings: map[string]int64{"": 0}, table: []string{""}}
+}
+
+// str is s's index in the string table, adding it if it's new.
+func (w *pprofWriter) str(s string) int64 {
+	if i, ok := w.strings[s]; ok {
+		return i
+	}
+	w.strings[s] = int64(len(w.table))
+	w.table = append(w.table, s)
+	return w.strings[s]
+}
+
+func (w *pprofWriter) valueType(num int, typ, unit string) {
+	var m protoBuf
+	m.int(pprofType, w.str(typ))
+	m.int(pprofUnit, w.str(unit))
+	w.profile.message(num, &m)
+}
+
+func (w *pprofWriter) function(id int64, name, filename string, line int) {
+	var m protoBuf
+	m.int(pprofID, id)
+	m.int(pprofName, w.str(name))
+	m.int(pprofFilename, w.str(filename))
+	m.int(pprofStartLine, int64(line))
+	w.profile.message(pprofFunction, &m)
+}
+
+func (w *pprofWriter) location(id, function int64, line int) {
+	var l protoBuf
+	l.int(pprofFunctionID, function)
+	l.int(pprofLineNumber, int64(line))
+	var m protoBuf
+	m.int(pprofID, id)
+	m.message(pprofLine, &l)
+	w.profile.message(pprofLocation, &m)
+}
+
+// sample adds a sample for the stack of locations, leaf first.
+func (w *pprofWriter) sample(stack []int64, values ...int64) {
+	var m protoBuf
+	m.packed(pprofLocationID, stack)
+	m.packed(pprofValue, values)
+	w.profile.message(pprofSample, &m)
+}
+
+// writeTo finishes the profile with its string table, and writes it out
+// gzipped.
+func (w *pprofWriter) writeTo(out io.Writer) error {
+	for _, s := range w.table {
+		w.profile.bytes(pprofStrings, []byte(s))
+	}
+	z := gzip.NewWriter(out)
+	if _, err := z.Write(w.profile.Bytes()); err != nil {
+		return err
+	}
+	return z.Close()
+}
@@ -0,0 +1,295 @@
+package bf
+
+// profile.go profiles running programs, by op and by loop, and points out
+// the hot spots that the optimizer could have done more with.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Profiler records where a VM spends its time: exactly how many times it runs
+// each op, and which op it's running every so often by the clock, which is
+// where the time goes.  Attach one to a VM with WithProfiler.
+//
+// A Profiler profiles one program.  Running it again adds to the profile,
+// but running a different one starts over.
+type Profiler struct {
+	interval time.Duration
+	ops      []Opcode
+	counts   []int64 // runs of each op
+	times    []int64 // nanoseconds sampled at each op
+	due      atomic.Bool
+	last     time.Time // when the last sample was taken
+	started  time.Time
+	duration time.Duration
+}
+
+// NewProfiler creates a Profiler that samples which op is running every
+// interval.
+func NewProfiler(interval time.Duration) *Profiler {
+	return &Profiler{interval: interval}
+}
+
+// begin starts profiling a run of ops, and returns a function that stops it.
+func (p *Profiler) begin(ops []Opcode) func() {
+	if !p.profiles(ops) {
+		p.ops = ops
+		p.counts = make([]int64, len(ops))
+		p.times = make([]int64, len(ops))
+		p.duration = 0
+		p.started = time.Now()
+	}
+	start := time.Now()
+	p.last = start
+	ticker := time.NewTicker(p.interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				p.due.Store(true)
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		p.duration += time.Since(start)
+	}
+}
+
+// profiles reports whether ops is the program p has been profiling.
+func (p *Profiler) profiles(ops []Opcode) bool {
+	return len(ops) == len(p.ops) && (len(ops) == 0 || &ops[0] == &p.ops[0])
+}
+
+// sample puts the time since the last sample down to op i.
+func (p *Profiler) sample(i int) {
+	p.due.Store(false)
+	now := time.Now()
+	p.times[i] += now.Sub(p.last).Nanoseconds()
+	p.last = now
+}
+
+// loopNests finds the loops around each op, innermost first, as the indices
+// of their RJumps.  A loop's RJump and LJump count as being inside it.
+func loopNests(ops []Opcode) [][]int {
+	nests := make([][]int, len(ops))
+	var open []int
+	for i, op := range ops {
+		if _, ok := op.(*RJump); ok {
+			open = append(open, i)
+		}
+		nest := make([]int, len(open))
+		for j := range open {
+			nest[j] = open[len(open)-1-j]
+		}
+		nests[i] = nest
+		if _, ok := op.(*LJump); ok {
+			open = open[:len(open)-1]
+		}
+	}
+	return nests
+}
+
+// maxLoopName is how much of a loop's compact source names it in a profile.
+const maxLoopName = 60
+
+// loopName is the compact source (see PrintOpsCompact) of the loop starting
+// at op i, cut short if it's long.
+func loopName(ops []Opcode, i int) string {
+	var b strings.Builder
+	PrintOpsCompact(&b, ops[i:ops[i].(*RJump).target+1])
+	if b.Len() > maxLoopName {
+		return b.String()[:maxLoopName] + "..."
+	}
+	return b.String()
+}
+
+// opName is the name of op's type, e.g. bf.Add.
+func opName(op Opcode) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", op), "*")
+}
+
+// WriteProfile writes the profile to w in pprof's format, for go tool pprof.
+// Each op's stack is the program, then the loops around it, named by their
+// compact source, then the kind of op it is, with op counts and sampled time
+// as the values, so pprof can show either by op kind or by loop nest.  The
+// Candidates go in as comments.  filename is the program's source, so that
+// pprof can show the profile line by line.
+func (p *Profiler) WriteProfile(w io.Writer, filename string) error {
+	pw := newPprofWriter()
+	pw.valueType(pprofSampleType, "ops", "count")
+	pw.valueType(pprofSampleType, "time", "nanoseconds")
+	pw.profile.int(pprofTime, p.started.UnixNano())
+	pw.profile.int(pprofDuration, p.duration.Nanoseconds())
+	pw.valueType(pprofPeriodType, "time", "nanoseconds")
+	pw.profile.int(pprofPeriod, p.interval.Nanoseconds())
+	for _, c := range p.Candidates() {
+		pw.profile.int(pprofComment, pw.str(c.String()))
+	}
+
+	// Functions are numbered from 1: the program, then each kind of op as
+	// it's first seen, then each loop.  Each op and each loop has a
+	// location, numbered from 1 for the ops and after them for the loops,
+	// and the program's is last.
+	n := int64(len(p.ops))
+	root := 2*n + 1
+	pw.function(1, "program", filename, 1)
+	pw.location(root, 1, 1)
+	kinds := map[string]int64{}
+	nextFunction := int64(2)
+	for i, op := range p.ops {
+		name := opName(op)
+		if _, ok := kinds[name]; !ok {
+			kinds[name] = nextFunction
+			pw.function(nextFunction, name, filename, 0)
+			nextFunction++
+		}
+		pw.location(int64(i)+1, kinds[name], Position(op).Line)
+	}
+	for i, op := range p.ops {
+		if _, ok := op.(*RJump); ok {
+			line := Position(op).Line
+			pw.function(nextFunction, loopName(p.ops, i), filename, line)
+			pw.location(n+1+int64(i), nextFunction, line)
+			nextFunction++
+		}
+	}
+
+	for i, nest := range loopNests(p.ops) {
+		if p.counts[i] == 0 && p.times[i] == 0 {
+			continue
+		}
+		stack := []int64{int64(i) + 1}
+		for _, loop := range nest {
+			stack = append(stack, n+1+int64(loop))
+		}
+		stack = append(stack, root)
+		pw.sample(stack, p.counts[i], p.times[i])
+	}
+	return pw.writeTo(w)
+}
+
+// Candidate is a hot spot in a profiled program that's a known idiom the
+// optimizer could replace with something quicker, but didn't, because its
+// pass didn't run or because it doesn't handle that form of it.
+type Candidate struct {
+	Op    int // the first op of it
+	Pos   Pos
+	Code  string // its compact source, as PrintOpsCompact writes it
+	Ops   int64
+	Share float64 // of all the ops run
+	Idiom string  // what it is, and what would do it quicker
+}
+
+// String describes c, e.g.
+//
+//	2:1: op 4, [-1+1>1+-1<], 96.0% of ops run: a loop that multiplies its cell into others, which the muladd pass makes a single MulAdd
+func (c Candidate) String() string {
+	return fmt.Sprintf("%v: op %d, %s, %.1f%% of ops run: %s", c.Pos, c.Op, c.Code, 100*c.Share, c.Idiom)
+}
+
+// candidateShare is how much of a run something has to be to be a Candidate.
+const candidateShare = 0.01
+
+// Candidates finds the hot spots in the profile that the optimizer could do
+// more with: loops that clear, scan or multiply, and runs of ops that could
+// have been combined.  Those that ran the most ops come first.
+func (p *Profiler) Candidates() []Candidate {
+	var total int64
+	for _, c := range p.counts {
+		total += c
+	}
+	if total == 0 {
+		return nil
+	}
+	var found []Candidate
+	add := func(start, end int, idiom string) {
+		var ops int64
+		for _, c := range p.counts[start:end] {
+			ops += c
+		}
+		if share := float64(ops) / float64(total); share >= candidateShare {
+			var b strings.Builder
+			PrintOpsCompact(&b, p.ops[start:end])
+			found = append(found, Candidate{
+				Op:    start,
+				Pos:   Position(p.ops[start]),
+				Code:  b.String(),
+				Ops:   ops,
+				Share: share,
+				Idiom: idiom,
+			})
+		}
+	}
+
+	for i, op := range p.ops {
+		if rjump, ok := op.(*RJump); ok {
+			if idiom := loopIdiom(p.ops[i+1 : rjump.target]); idiom != "" {
+				add(i, rjump.target+1, idiom)
+			}
+			continue
+		}
+		// Runs are only counted from their start.
+		if i > 0 && combinable(p.ops[i-1], op) {
+			continue
+		}
+		end := i + 1
+		for end < len(p.ops) && combinable(p.ops[end-1], p.ops[end]) {
+			end++
+		}
+		if end > i+1 {
+			add(i, end, "a run of ops on one cell, or of moves, which the combine pass makes one op")
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Ops > found[j].Ops
+	})
+	return found
+}
+
+// combinable reports whether a and b, one after the other, could be one op.
+func combinable(a, b Opcode) bool {
+	switch a := a.(type) {
+	case *Add:
+		b, ok := b.(*Add)
+		return ok && a.offset == b.offset
+	case *Move:
+		_, ok := b.(*Move)
+		return ok
+	}
+	return false
+}
+
+// loopIdiom says what a loop with body does, if it's an idiom: a scan (see
+// scanStep), or a balanced loop (see optimizeMulAdd) that clears or
+// multiplies.  It's empty if the body is anything else.
+func loopIdiom(body []Opcode) string {
+	if _, ok := scanStep(body); ok {
+		return "a loop that scans for an empty cell, which the scan pass makes a single FindEmpty"
+	}
+	offset, step, terms, ok := loopEffect(body)
+	if !ok || offset != 0 {
+		return ""
+	}
+	others := len(terms) > 0
+	switch {
+	case step == -1 && !others:
+		return "a loop that clears its cell, which the clear pass makes a single Clear"
+	case step == -1:
+		return "a loop that multiplies its cell into others, which the muladd pass makes a single MulAdd"
+	case step == 1:
+		return "a loop that counts its cell up to zero, which nothing optimizes yet, but with wrapping cells is a Clear or MulAdd of minus the cell"
+	case step != 0:
+		return fmt.Sprintf("a loop that counts its cell down by %d, which nothing optimizes yet, but could be a Clear or MulAdd if the cell divides", -step)
+	}
+	return ""
+}
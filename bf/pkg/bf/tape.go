@@ -0,0 +1,146 @@
+package bf
+
+// tape.go decides what happens when a program goes off either end of the tape.
+
+import "fmt"
+
+// TapePolicy says what a VM does when a program goes off either end of its
+// tape.
+type TapePolicy int
+
+const (
+	// TapeWrap carries on from the other end, like compiled programs do.
+	TapeWrap TapePolicy = iota
+	// TapeFail stops the program with a *TapeError.  It's checked on the
+	// optimized ops, so a program whose pointer only goes off the tape on
+	// the way somewhere else, like `<>`, doesn't fail once the moves are
+	// combined.
+	TapeFail
+	// TapeGrow adds cells to whichever end the program went off, so the
+	// tape goes on forever both ways, up to the tape size in all.
+	TapeGrow
+)
+
+// tapePolicies are the policies' names, for ParseTapePolicy and String.
+var tapePolicies = []string{"wrap", "error", "grow"}
+
+// ParseTapePolicy finds the policy called name: "wrap", "error" or "grow".
+func ParseTapePolicy(name string) (TapePolicy, error) {
+	for i, policy := range tapePolicies {
+		if policy == name {
+			return TapePolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tape policy %q: must be wrap, error or grow", name)
+}
+
+func (p TapePolicy) String() string {
+	if p < 0 || int(p) >= len(tapePolicies) {
+		return fmt.Sprintf("TapePolicy(%d)", int(p))
+	}
+	return tapePolicies[p]
+}
+
+// initialGrowth is how many cells a VM that grows its tape starts with.
+const initialGrowth = 1024
+
+// reach is how far to the left and right of the pointer op touches a cell or
+// leaves the pointer, when the current cell holds current.  Transfer and
+// MulAdd are loops that don't run at all if it's 0, so they don't reach
+// anywhere then.  FindEmpty's depends on the tape, so it checks as it goes
+// instead.
+func reach(op Opcode, current int) (int, int) {
+	switch v := op.(type) {
+	case *Move:
+		return v.amount, v.amount
+	case *Add:
+		return v.offset, v.offset
+	case *Output:
+		return v.offset, v.offset
+	case *Input:
+		return v.offset, v.offset
+	case *Clear:
+		return v.offset, v.offset
+	case *Transfer:
+		if current == 0 {
+			return 0, 0
+		}
+		return min(v.distance, 0), max(v.distance, 0)
+	case *MulAdd:
+		if current == 0 {
+			return 0, 0
+		}
+		lo, hi := 0, 0
+		for _, term := range v.terms {
+			lo, hi = min(lo, term.offset), max(hi, term.offset)
+		}
+		return lo, hi
+	}
+	return 0, 0
+}
+
+// fitTape makes sure that the cells from lo to hi either side of the pointer,
+// at d, are on the tape before op i runs, growing it or failing as the tape
+// policy says.  It returns where the pointer is afterwards, which moves if the
+// tape grows to the left.  It's never called for TapeWrap, where every op
+// wraps its own cells.
+func (vm *VM) fitTape(i int, op Opcode, d, lo, hi int) (int, error) {
+	if d+lo < 0 {
+		c, err := vm.offTape(i, op, d+lo)
+		if err != nil {
+			return d, err
+		}
+		d = c - lo
+	}
+	if d+hi >= len(vm.buffer) {
+		c, err := vm.offTape(i, op, d+hi)
+		if err != nil {
+			return d, err
+		}
+		d = c - hi
+	}
+	return d, nil
+}
+
+// offTape handles op i reaching for the cell at index c, which is off one
+// end of the tape, and returns the index of the cell it should get instead.
+func (vm *VM) offTape(i int, op Opcode, c int) (int, error) {
+	size := len(vm.buffer)
+	switch vm.policy {
+	case TapeWrap:
+		return wrapIndex(c, size), nil
+	case TapeGrow:
+		if shift, ok := vm.grow(c); ok {
+			return c + shift, nil
+		}
+	}
+	err := &TapeError{Op: i, Opcode: op, Cell: c - vm.origin, Left: c < 0}
+	if vm.policy == TapeGrow {
+		err.Limit = vm.tapeSize
+	}
+	return c, err
+}
+
+// grow adds cells to the tape so that it takes in index c, at least doubling
+// it so that growing is rare, but keeping it within the tape size.  If the
+// cells go on the left, everything moves along by that many, which it
+// returns.  It reports false if the tape can't get that big.
+func (vm *VM) grow(c int) (int, bool) {
+	size := len(vm.buffer)
+	need := max(c+1, size-c)
+	if need > vm.tapeSize {
+		return 0, false
+	}
+	buffer := make([]int, min(max(2*size, need), vm.tapeSize))
+	shift := 0
+	if c < 0 {
+		shift = len(buffer) - size
+	}
+	copy(buffer[shift:], vm.buffer)
+	vm.buffer = buffer
+	vm.origin += shift
+	if vm.history != nil && shift > 0 {
+		vm.history.shift(shift)
+	}
+	return shift, true
+}
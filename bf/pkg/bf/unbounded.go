@@ -0,0 +1,203 @@
+package bf
+
+// unbounded.go runs programs whose cells are integers of any size, using
+// math/big rather than a machine word.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"unicode/utf8"
+)
+
+// UnboundedCells, as a cell width, makes each cell an integer of any size,
+// which never wraps around.  Only the VM can run them.
+const UnboundedCells = 0
+
+// byteMask is the low 8 bits of a cell, which EncodeBytes writes.
+var byteMask = big.NewInt(0xff)
+
+// unboundedInvalid says why the VM's other options can't go with unbounded
+// cells, if they can't.  The JIT and the backends only know machine words,
+// and a VM with unbounded cells keeps them on a tape of its own, which
+// doesn't grow and which step hooks and history can't see.
+func (vm *VM) unboundedInvalid() error {
+	switch {
+	case vm.jit:
+		return errors.New("the JIT only runs cells of a fixed width, not unbounded ones")
+	case vm.policy == TapeGrow:
+		return errors.New("unbounded cells need a tape that doesn't grow")
+	case vm.stepHook != nil || vm.history != nil:
+		return errors.New("unbounded cells can't be stepped through or run backwards")
+	}
+	return nil
+}
+
+// BigCell returns the value of cell n, counting from the one the program
+// started on, whatever the cell width.  With unbounded cells, it's the only
+// way to see all of a cell too big for an int.
+func (vm *VM) BigCell(n int) *big.Int {
+	if vm.cellBits == UnboundedCells {
+		if n >= 0 && n < len(vm.bigTape) {
+			return new(big.Int).Set(&vm.bigTape[n])
+		}
+		return new(big.Int)
+	}
+	return big.NewInt(int64(vm.Cell(n)))
+}
+
+// runUnbounded is RunContext for unbounded cells.  It's the same loop, less
+// what unboundedInvalid rules out, doing its arithmetic with math/big.
+func (vm *VM) runUnbounded(ctx context.Context, ops []Opcode) (err error) {
+	i := 0
+	d := vm.d
+	tape := vm.bigTape
+	size := len(tape)
+	var amount, product big.Int
+	done := ctx.Done()
+	backJumps := 0
+	ran, budget := 0, -1
+	if vm.maxOps > 0 {
+		budget = vm.maxOps
+	}
+	vm.written = 0
+	prof := vm.profiler
+	if prof != nil {
+		defer prof.begin(ops)()
+	}
+	defer func() {
+		vm.d = d
+		if flushErr := vm.out.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
+
+	for i >= 0 && i < len(ops) {
+		if ran == budget {
+			return vm.limitError(LimitOps, ops, i, d, ran, nil)
+		}
+		ran++
+		if prof != nil {
+			prof.counts[i]++
+			if prof.due.Load() {
+				prof.sample(i)
+			}
+		}
+		if vm.trace != nil {
+			fmt.Fprintf(vm.trace, "%05d: %T%v %s, %d: [%d]\n", i, ops[i], ops[i], snippet(ops[i]), d, &tape[d])
+		}
+		if vm.countLoop {
+			vm.opCount++
+		}
+		if vm.policy == TapeFail {
+			if lo, hi := reach(ops[i], tape[d].Sign()); d+lo < 0 || d+hi >= size {
+				c := d + hi
+				if d+lo < 0 {
+					c = d + lo
+				}
+				return &TapeError{Op: i, Opcode: ops[i], Cell: c, Left: c < 0}
+			}
+		}
+		switch v := ops[i].(type) {
+		case *Move:
+			d = wrapIndex(d+v.amount, size)
+		case *Add:
+			c := &tape[wrapIndex(d+v.offset, size)]
+			c.Add(c, amount.SetInt64(int64(v.amount)))
+		case *Output:
+			c := &tape[wrapIndex(d+v.offset, size)]
+			if !vm.fitsBigOutput(c) {
+				return vm.limitError(LimitOutput, ops, i, d, ran-1, nil)
+			}
+			vm.writeBigCell(c)
+		case *Input:
+			c, ok, err := vm.readCell(i)
+			if err != nil {
+				return err
+			}
+			if ok {
+				tape[wrapIndex(d+v.offset, size)].SetInt64(int64(c))
+			}
+		case *RJump:
+			if vm.countLoop {
+				vm.loopCount[i] += 1
+			}
+			if tape[d].Sign() == 0 {
+				i = v.target
+			}
+		case *LJump:
+			if tape[d].Sign() != 0 {
+				backJumps++
+				if done != nil && backJumps%cancelCheckInterval == 0 && isDone(done) {
+					return vm.limitError(contextLimit(ctx.Err()), ops, i, d, ran-1, ctx.Err())
+				}
+				i = v.target
+			}
+		case *Clear:
+			tape[wrapIndex(d+v.offset, size)].SetInt64(0)
+		case *Transfer:
+			c := &tape[wrapIndex(d+v.distance, size)]
+			c.Add(c, &tape[d])
+			tape[d].SetInt64(0)
+		case *MulAdd:
+			for _, term := range v.terms {
+				c := &tape[wrapIndex(d+term.offset, size)]
+				c.Add(c, product.Mul(&tape[d], amount.SetInt64(int64(term.factor))))
+			}
+			tape[d].SetInt64(0)
+		case *FindEmpty:
+			for tape[d].Sign() != 0 {
+				if ran == budget {
+					return vm.limitError(LimitOps, ops, i, d, ran, nil)
+				}
+				ran++
+				backJumps++
+				if done != nil && backJumps%cancelCheckInterval == 0 && isDone(done) {
+					return vm.limitError(contextLimit(ctx.Err()), ops, i, d, ran-1, ctx.Err())
+				}
+				d += v.step
+				if d < 0 || d >= size {
+					if vm.policy == TapeFail {
+						return &TapeError{Op: i, Opcode: ops[i], Cell: d, Left: d < 0}
+					}
+					d = wrapIndex(d, size)
+				}
+			}
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", ops[i], i)
+		}
+		i++
+	}
+	return nil
+}
+
+// writeBigCell is writeCell for an unbounded cell.  One too big for an int
+// is written in full as a number, as its low 8 bits as a byte, and as U+FFFD
+// as a character, since it can't be one.
+func (vm *VM) writeBigCell(value *big.Int) {
+	switch {
+	case value.IsInt64():
+		vm.writeCell(int(value.Int64()))
+	case vm.outEncoding == EncodeNumbers:
+		vm.out.WriteString(value.String())
+		vm.out.WriteByte(' ')
+	case vm.outEncoding == EncodeUTF8:
+		vm.out.WriteRune(utf8.RuneError)
+	default:
+		vm.out.WriteByte(byte(new(big.Int).And(value, byteMask).Uint64()))
+	}
+}
+
+// fitsBigOutput is fitsOutput for an unbounded cell.
+func (vm *VM) fitsBigOutput(value *big.Int) bool {
+	switch {
+	case value.IsInt64():
+		return vm.fitsOutput(int(value.Int64()))
+	case vm.outEncoding == EncodeNumbers:
+		return vm.fitsBytes(len(value.String()) + 1)
+	case vm.outEncoding == EncodeUTF8:
+		return vm.fitsBytes(utf8.RuneLen(utf8.RuneError))
+	}
+	return vm.fitsBytes(1)
+}
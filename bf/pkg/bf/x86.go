@@ -0,0 +1,490 @@
+package bf
+
+// x86.go contains a tiny x86-64 machine code assembler, just big enough for
+// lowering opcodes to native code without an external assembler, and the
+// lowering itself.
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// x86Reg is a general purpose register number, as used in instruction
+// encodings.
+type x86Reg byte
+
+const (
+	rax x86Reg = iota
+	rcx
+	rdx
+	rbx
+	rsp
+	rbp
+	rsi
+	rdi
+	r8
+	r9
+	r10
+	r11
+	r12
+	r13
+	r14
+	r15
+)
+
+// noIndex marks an x86Mem without an index register.
+const noIndex x86Reg = 0xff
+
+// x86Mem is a memory operand: [base + index*scale + disp].
+type x86Mem struct {
+	base  x86Reg
+	index x86Reg
+	scale byte
+	disp  int32
+}
+
+// cellAt is the memory operand for the cell at tape[index], with the tape's
+// address in base.
+func cellAt(base x86Reg, index x86Reg, width int) x86Mem {
+	return x86Mem{base: base, index: index, scale: byte(width)}
+}
+
+// x86Label is a position in the code that jumps can refer to before it's
+// been placed.
+type x86Label int
+
+// x86Fixup is a rel32 field waiting on a label's position.
+type x86Fixup struct {
+	at    int // offset of the rel32 field
+	label x86Label
+}
+
+// x86Asm accumulates machine code.
+type x86Asm struct {
+	code   []byte
+	labels []int // code offset of each label, or -1 until it's placed
+	fixups []x86Fixup
+}
+
+// newLabel makes a label that can be jumped to and placed later.
+func (a *x86Asm) newLabel() x86Label {
+	a.labels = append(a.labels, -1)
+	return x86Label(len(a.labels) - 1)
+}
+
+// place sets the label to point at the next instruction.
+func (a *x86Asm) place(l x86Label) {
+	a.labels[l] = len(a.code)
+}
+
+// link fills in every jump with its label's position.
+func (a *x86Asm) link() error {
+	for _, f := range a.fixups {
+		target := a.labels[f.label]
+		if target < 0 {
+			return fmt.Errorf("x86: label %d was never placed", f.label)
+		}
+		rel := target - (f.at + 4)
+		binary.LittleEndian.PutUint32(a.code[f.at:], uint32(int32(rel)))
+	}
+	return nil
+}
+
+func (a *x86Asm) bytes(b ...byte) {
+	a.code = append(a.code, b...)
+}
+
+func (a *x86Asm) imm16(v int64) {
+	a.code = binary.LittleEndian.AppendUint16(a.code, uint16(v))
+}
+
+func (a *x86Asm) imm32(v int64) {
+	a.code = binary.LittleEndian.AppendUint32(a.code, uint32(v))
+}
+
+func (a *x86Asm) imm64(v int64) {
+	a.code = binary.LittleEndian.AppendUint64(a.code, uint64(v))
+}
+
+// rel32 writes a placeholder for the distance to label.
+func (a *x86Asm) rel32(l x86Label) {
+	a.fixups = append(a.fixups, x86Fixup{len(a.code), l})
+	a.imm32(0)
+}
+
+// prefixes writes the operand size prefix and REX byte for an instruction
+// on width byte operands.  reg is the ModRM reg field, and x and b are the
+// registers that end up in the SIB index and ModRM rm/SIB base fields.
+func (a *x86Asm) prefixes(width int, reg, x, b x86Reg) {
+	if width == 2 {
+		a.bytes(0x66)
+	}
+	rex := byte(0x40)
+	if width == 8 {
+		rex |= 0x08
+	}
+	if reg&8 != 0 {
+		rex |= 0x04
+	}
+	if x != noIndex && x&8 != 0 {
+		rex |= 0x02
+	}
+	if b&8 != 0 {
+		rex |= 0x01
+	}
+	if rex != 0x40 {
+		a.bytes(rex)
+	}
+}
+
+// modrmMem writes the ModRM, SIB and displacement bytes for a memory operand.
+func (a *x86Asm) modrmMem(reg x86Reg, m x86Mem) {
+	var mod byte
+	switch {
+	case m.disp == 0 && m.base&7 != rbp:
+		mod = 0
+	case m.disp == int32(int8(m.disp)):
+		mod = 1
+	default:
+		mod = 2
+	}
+
+	if m.index == noIndex && m.base&7 != rsp {
+		a.bytes(mod<<6 | byte(reg&7)<<3 | byte(m.base&7))
+	} else {
+		index := byte(rsp) // rsp as an index means none
+		scale := byte(0)
+		if m.index != noIndex {
+			index = byte(m.index & 7)
+			scale = map[byte]byte{1: 0, 2: 1, 4: 2, 8: 3}[m.scale]
+		}
+		a.bytes(mod<<6|byte(reg&7)<<3|4, scale<<6|index<<3|byte(m.base&7))
+	}
+
+	switch mod {
+	case 1:
+		a.bytes(byte(m.disp))
+	case 2:
+		a.imm32(int64(m.disp))
+	}
+}
+
+// memOp writes an instruction with a memory operand.  op8 is the opcode for
+// byte operands and op the opcode for everything wider.
+func (a *x86Asm) memOp(width int, op8, op []byte, reg x86Reg, m x86Mem) {
+	a.prefixes(width, reg, m.index, m.base)
+	if width == 1 {
+		a.bytes(op8...)
+	} else {
+		a.bytes(op...)
+	}
+	a.modrmMem(reg, m)
+}
+
+// regOp writes a 64 bit register to register instruction.
+func (a *x86Asm) regOp(op []byte, reg, rm x86Reg) {
+	a.prefixes(8, reg, noIndex, rm)
+	a.bytes(op...)
+	a.bytes(0xc0 | byte(reg&7)<<3 | byte(rm&7))
+}
+
+// immediate writes an immediate of the operand's width (at most 32 bits).
+func (a *x86Asm) immediate(width int, v int64) {
+	switch width {
+	case 1:
+		a.bytes(byte(v))
+	case 2:
+		a.imm16(v)
+	default:
+		a.imm32(v)
+	}
+}
+
+// addMemImm adds v to the width byte value at m.  For 8 byte operands, v
+// must fit in 32 bits.
+func (a *x86Asm) addMemImm(width int, m x86Mem, v int64) {
+	a.memOp(width, []byte{0x80}, []byte{0x81}, 0, m)
+	a.immediate(width, v)
+}
+
+// cmpMemZero compares the width byte value at m with zero.
+func (a *x86Asm) cmpMemZero(width int, m x86Mem) {
+	a.memOp(width, []byte{0x80}, []byte{0x83}, 7, m)
+	a.bytes(0)
+}
+
+// movMemImm stores v into the width byte value at m.
+func (a *x86Asm) movMemImm(width int, m x86Mem, v int64) {
+	a.memOp(width, []byte{0xc6}, []byte{0xc7}, 0, m)
+	a.immediate(width, v)
+}
+
+// addMemReg adds the low width bytes of r to the value at m.
+func (a *x86Asm) addMemReg(width int, m x86Mem, r x86Reg) {
+	a.memOp(width, []byte{0x00}, []byte{0x01}, r, m)
+}
+
+// movMemReg stores the low width bytes of r at m.
+func (a *x86Asm) movMemReg(width int, m x86Mem, r x86Reg) {
+	a.memOp(width, []byte{0x88}, []byte{0x89}, r, m)
+}
+
+// loadZeroExtend loads the width byte value at m into all of r.
+func (a *x86Asm) loadZeroExtend(width int, r x86Reg, m x86Mem) {
+	switch width {
+	case 1:
+		a.memOp(8, nil, []byte{0x0f, 0xb6}, r, m)
+	case 2:
+		a.memOp(8, nil, []byte{0x0f, 0xb7}, r, m)
+	case 4:
+		a.memOp(4, nil, []byte{0x8b}, r, m)
+	default:
+		a.memOp(8, nil, []byte{0x8b}, r, m)
+	}
+}
+
+// movRegMem loads the 8 byte value at m into r.
+func (a *x86Asm) movRegMem(r x86Reg, m x86Mem) {
+	a.memOp(8, nil, []byte{0x8b}, r, m)
+}
+
+// jmpMem jumps to the address stored at m.
+func (a *x86Asm) jmpMem(m x86Mem) {
+	a.memOp(4, nil, []byte{0xff}, 4, m)
+}
+
+// subMemImm subtracts a 32 bit immediate from the 8 byte value at m.
+func (a *x86Asm) subMemImm(m x86Mem, v int64) {
+	a.memOp(8, nil, []byte{0x81}, 5, m)
+	a.imm32(v)
+}
+
+// leaLabel loads the address of l into r.
+func (a *x86Asm) leaLabel(r x86Reg, l x86Label) {
+	a.prefixes(8, r, noIndex, 0)
+	a.bytes(0x8d, byte(r&7)<<3|5) // [rip + rel32]
+	a.rel32(l)
+}
+
+// lea loads the address m into r.
+func (a *x86Asm) lea(r x86Reg, m x86Mem) {
+	a.memOp(8, nil, []byte{0x8d}, r, m)
+}
+
+// addRegImm adds a 32 bit immediate to r.
+func (a *x86Asm) addRegImm(r x86Reg, v int64) {
+	a.prefixes(8, 0, noIndex, r)
+	a.bytes(0x81, 0xc0|byte(r&7))
+	a.imm32(v)
+}
+
+// cmpRegImm compares r with a 32 bit immediate.
+func (a *x86Asm) cmpRegImm(r x86Reg, v int64) {
+	a.prefixes(8, 0, noIndex, r)
+	a.bytes(0x81, 0xf8|byte(r&7))
+	a.imm32(v)
+}
+
+// movRegImm loads a 64 bit immediate into r.
+func (a *x86Asm) movRegImm(r x86Reg, v int64) {
+	a.prefixes(8, 0, noIndex, r)
+	a.bytes(0xb8 | byte(r&7))
+	a.imm64(v)
+}
+
+// movRegReg copies src into dst.
+func (a *x86Asm) movRegReg(dst, src x86Reg) {
+	a.regOp([]byte{0x89}, src, dst)
+}
+
+// cmovae copies src into dst if the last comparison was above or equal
+// (unsigned).
+func (a *x86Asm) cmovae(dst, src x86Reg) {
+	a.regOp([]byte{0x0f, 0x43}, dst, src)
+}
+
+// imulRegReg multiplies dst by src.
+func (a *x86Asm) imulRegReg(dst, src x86Reg) {
+	a.regOp([]byte{0x0f, 0xaf}, dst, src)
+}
+
+// zeroReg sets r to zero.
+func (a *x86Asm) zeroReg(r x86Reg) {
+	a.prefixes(4, r, noIndex, r)
+	a.bytes(0x31, 0xc0|byte(r&7)<<3|byte(r&7))
+}
+
+// incReg adds one to r.
+func (a *x86Asm) incReg(r x86Reg) {
+	a.prefixes(8, 0, noIndex, r)
+	a.bytes(0xff, 0xc0|byte(r&7))
+}
+
+// testReg sets the flags on whether r is zero.
+func (a *x86Asm) testReg(r x86Reg) {
+	a.regOp([]byte{0x85}, r, r)
+}
+
+// Conditions for jcc, as the low nibble of the opcode.
+const (
+	condB  = 0x2
+	condAE = 0x3
+	condE  = 0x4
+	condNE = 0x5
+)
+
+// jcc jumps to l if cond holds.
+func (a *x86Asm) jcc(cond byte, l x86Label) {
+	a.bytes(0x0f, 0x80|cond)
+	a.rel32(l)
+}
+
+// jmp jumps to l.
+func (a *x86Asm) jmp(l x86Label) {
+	a.bytes(0xe9)
+	a.rel32(l)
+}
+
+// call calls the code at l.
+func (a *x86Asm) call(l x86Label) {
+	a.bytes(0xe8)
+	a.rel32(l)
+}
+
+func (a *x86Asm) ret() {
+	a.bytes(0xc3)
+}
+
+func (a *x86Asm) syscall() {
+	a.bytes(0x0f, 0x05)
+}
+
+func (a *x86Asm) push(r x86Reg) {
+	a.prefixes(4, 0, noIndex, r)
+	a.bytes(0x50 | byte(r&7))
+}
+
+func (a *x86Asm) pop(r x86Reg) {
+	a.prefixes(4, 0, noIndex, r)
+	a.bytes(0x58 | byte(r&7))
+}
+
+// Registers that lowered code keeps its state in.  The output buffer
+// registers are only used by the runtime's I/O code.
+const (
+	tapeReg    = rbx // address of the tape
+	pointerReg = r12 // index of the current cell
+	outBufReg  = r13 // address of the output buffer
+	outLenReg  = r14 // number of entries waiting in the output buffer
+)
+
+// nativeRuntime writes the parts of lowering that depend on where the code
+// will run: I/O, and what happens at the bottom of a loop.
+type nativeRuntime interface {
+	// output writes the current cell, whose address is in rsi.
+	output(a *x86Asm)
+	// input reads into the current cell, whose address is in rsi, doing
+	// what the config's EOF mode says at the end of input.
+	input(a *x86Asm, op int)
+	// loopBack jumps back to the top of a loop, at open, if the flags say
+	// the current cell isn't zero.  op is the LJump's index, or the
+	// FindEmpty's for the loop that scans.
+	loopBack(a *x86Asm, op int, open x86Label)
+}
+
+// lowerOps writes machine code for ops.  It expects the tape's address in
+// tapeReg and the pointer in pointerReg, and leaves them there.  It can use
+// rax, rcx and rdx, as well as rsi for I/O.
+func lowerOps(a *x86Asm, ops []Opcode, config Config, rt nativeRuntime) error {
+	width := config.CellBits / 8
+	current := cellAt(tapeReg, pointerReg, width)
+	loops := map[int][2]x86Label{}
+
+	for i, op := range ops {
+		switch v := op.(type) {
+		case *Add:
+			lowerAdd(a, width, lowerOffset(a, config, v.offset), v.amount)
+		case *Move:
+			lowerMove(a, config, pointerReg, v.amount)
+		case *Output:
+			a.lea(rsi, lowerOffset(a, config, v.offset))
+			rt.output(a)
+		case *Input:
+			a.lea(rsi, lowerOffset(a, config, v.offset))
+			rt.input(a, i)
+		case *RJump:
+			open, close := a.newLabel(), a.newLabel()
+			loops[i] = [2]x86Label{open, close}
+			a.cmpMemZero(width, current)
+			a.jcc(condE, close)
+			a.place(open)
+		case *LJump:
+			labels := loops[v.target]
+			a.cmpMemZero(width, current)
+			rt.loopBack(a, i, labels[0])
+			a.place(labels[1])
+		case *Clear:
+			a.movMemImm(width, lowerOffset(a, config, v.offset), 0)
+		case *Transfer:
+			a.loadZeroExtend(width, rax, current)
+			a.movRegReg(rcx, pointerReg)
+			lowerMove(a, config, rcx, v.distance)
+			a.addMemReg(width, cellAt(tapeReg, rcx, width), rax)
+			a.movMemImm(width, current, 0)
+		case *MulAdd:
+			a.loadZeroExtend(width, rax, current)
+			for _, term := range v.terms {
+				// lowerMove uses rdx, so the product has to wait.
+				a.movRegReg(rcx, pointerReg)
+				lowerMove(a, config, rcx, term.offset)
+				a.movRegImm(rdx, int64(term.factor))
+				a.imulRegReg(rdx, rax)
+				a.addMemReg(width, cellAt(tapeReg, rcx, width), rdx)
+			}
+			a.movMemImm(width, current, 0)
+		case *FindEmpty:
+			loop, check := a.newLabel(), a.newLabel()
+			a.jmp(check)
+			a.place(loop)
+			lowerMove(a, config, pointerReg, v.step)
+			a.place(check)
+			a.cmpMemZero(width, current)
+			rt.loopBack(a, i, loop)
+		default:
+			return fmt.Errorf("unrecognized opcode %T at op %d", op, i)
+		}
+	}
+	return nil
+}
+
+// lowerOffset returns the memory operand for the cell offset cells from the
+// current one, working out its index into rcx if it's not the current one.
+func lowerOffset(a *x86Asm, config Config, offset int) x86Mem {
+	width := config.CellBits / 8
+	if offset == 0 {
+		return cellAt(tapeReg, pointerReg, width)
+	}
+	a.movRegReg(rcx, pointerReg)
+	lowerMove(a, config, rcx, offset)
+	return cellAt(tapeReg, rcx, width)
+}
+
+// lowerAdd adds amount to the cell at m.
+func lowerAdd(a *x86Asm, width int, m x86Mem, amount int) {
+	v := int64(amount)
+	if width == 8 && v != int64(int32(v)) {
+		// Only 32 bit immediates can be added to memory.
+		a.movRegImm(rax, v)
+		a.addMemReg(width, m, rax)
+		return
+	}
+	a.addMemImm(width, m, v)
+}
+
+// lowerMove moves the cell index in r by amount, wrapping around the tape.
+func lowerMove(a *x86Asm, config Config, r x86Reg, amount int) {
+	a.addRegImm(r, int64(config.wrapOffset(amount)))
+	a.lea(rdx, x86Mem{base: r, index: noIndex, disp: int32(-config.TapeSize)})
+	a.cmpRegImm(r, int64(config.TapeSize))
+	a.cmovae(r, rdx)
+}
@@ -0,0 +1,204 @@
+package main
+
+// repl.go contains the interactive repl and its meta-commands
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rpalo/learning/bf/pkg/bf"
+)
+
+const REPL_HELP = `
+Enter bf code to run it.  The buffer and pointer are kept between lines, and a
+line with an unclosed '[' continues onto the next line.
+
+meta-commands:
+	:tape [N]: show N cells (default 8) either side of the pointer
+	:ptr: show the pointer position
+	:reset: zero the buffer and move the pointer back to the start
+	:load FILENAME: compile and run the bf file at FILENAME in this session
+	:ops: show the opcodes for the last code that was run
+	:help: show this message
+	:quit: leave the repl (so does an empty line or EOF)
+`
+
+// replSession is the state the repl carries between lines.
+type replSession struct {
+	vm      *bf.VM
+	out     *tailWriter
+	lastOps []bf.Opcode
+}
+
+// tailWriter passes writes on to w, remembering the last byte written since
+// it was last reset, so the repl knows whether a program's output ended its
+// line.
+type tailWriter struct {
+	w       io.Writer
+	last    byte
+	written bool
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		t.last, t.written = p[len(p)-1], true
+	}
+	return t.w.Write(p)
+}
+
+// endLine starts a new line if anything written since the last call didn't
+// end with one.
+func (t *tailWriter) endLine() {
+	if t.written && t.last != '\n' {
+		fmt.Fprintln(t.w)
+	}
+	t.written = false
+}
+
+// repl interprets bf syntax interactively in a REPL.
+func repl() {
+	reader := bufio.NewReader(os.Stdin)
+	out := &tailWriter{w: os.Stdout}
+	opts := append(vmOptions(), bf.WithInput(reader), bf.WithOutput(out))
+	session := &replSession{vm: bf.NewVM(opts...), out: out}
+	pending := ""
+
+	for {
+		if pending == "" {
+			fmt.Print("bf> ")
+		} else {
+			fmt.Print("... ")
+		}
+		line, err := reader.ReadString('\n')
+
+		if errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if pending == "" {
+			if len(line) == 0 {
+				return
+			}
+			if strings.HasPrefix(line, ":") {
+				if quit := session.meta(line); quit {
+					return
+				}
+				continue
+			}
+		}
+
+		pending += line + "\n"
+		if openLoops(pending) > 0 {
+			continue
+		}
+		session.eval(pending)
+		pending = ""
+	}
+}
+
+// openLoops counts how many '[' in source are still waiting on their ']'.
+func openLoops(source string) int {
+	depth := 0
+	for _, c := range source {
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		}
+	}
+	return depth
+}
+
+// eval compiles source, named for error messages by any options, and runs
+// it against the session's state.
+func (s *replSession) eval(source string, opts ...bf.CompileOption) {
+	program, err := bf.Compile(source, opts...)
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	s.lastOps = program.Ops
+	err = s.vm.Run(program.Ops)
+	s.out.endLine()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// meta runs a ':' command and reports whether the repl should exit.
+func (s *replSession) meta(line string) bool {
+	fields := strings.Fields(line)
+
+	switch fields[0] {
+	case ":tape":
+		width := 8
+		if len(fields) > 1 {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 0 {
+				fmt.Printf("Not a cell count: %s\n", fields[1])
+				return false
+			}
+			width = n
+		}
+		s.printTape(width)
+	case ":ptr":
+		fmt.Println(s.vm.Pointer() - s.vm.Origin())
+	case ":reset":
+		s.vm.Reset()
+		s.lastOps = nil
+	case ":load":
+		if len(fields) != 2 {
+			fmt.Println("usage: :load FILENAME")
+			return false
+		}
+		contents, err := os.ReadFile(fields[1])
+
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		s.eval(string(contents), bf.WithFilename(fields[1]))
+	case ":ops":
+		bf.PrintOps(os.Stdout, s.lastOps)
+	case ":help":
+		fmt.Print(REPL_HELP)
+	case ":quit", ":q":
+		return true
+	default:
+		fmt.Printf("Unknown command %s, try :help\n", fields[0])
+	}
+	return false
+}
+
+// printTape shows the cells within width of the pointer.
+func (s *replSession) printTape(width int) {
+	origin := s.vm.Origin()
+	d := s.vm.Pointer() - origin
+	printCells(s.vm, max(d-width, -origin), min(d+width+1, s.vm.TapeLen()-origin))
+}
+
+// printCells shows vm's cells from start up to end, numbered from the one the
+// program started on, with the pointer's cell bracketed.
+func printCells(vm *bf.VM, start, end int) {
+	d := vm.Pointer() - vm.Origin()
+	fmt.Printf("%d:", start)
+	for i := start; i < end; i++ {
+		if i == d {
+			fmt.Printf(" [%d]", vm.BigCell(i))
+		} else {
+			fmt.Printf(" %d", vm.BigCell(i))
+		}
+	}
+	fmt.Println()
+}